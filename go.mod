@@ -2,4 +2,4 @@ module larva
 
 go 1.21
 
-require github.com/BurntSushi/toml v1.6.0 // indirect
+require github.com/BurntSushi/toml v1.6.0
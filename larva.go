@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -17,42 +26,94 @@ import (
 // --- Config schema ---
 
 type Config struct {
-	Project   Project            `toml:"project"`
-	Targets   map[string]Target  `toml:"targets"`
-	PostBuild []PostBuild        `toml:"post_build"`
-	Commands  map[string]Command `toml:"commands"`
+	Project    Project              `toml:"project"`
+	Targets    map[string]Target    `toml:"targets"`
+	PostBuild  []PostBuild          `toml:"post_build"`
+	Commands   map[string]Command   `toml:"commands"`
+	Cache      Cache                `toml:"cache"`
+	Modes      map[string]BuildMode `toml:"modes"` // project-wide defaults per build mode
+	Toolchains map[string]Toolchain `toml:"toolchains"`
+	Rules      []Rule               `toml:"rules"`
+	Golden     []Golden             `toml:"golden"`
 }
 
 type Project struct {
-	Name       string            `toml:"name"`
-	Compiler   string            `toml:"compiler"`
-	BuildCache string            `toml:"buildcache"`
-	Vars       map[string]string `toml:"vars"`
+	Name          string            `toml:"name"`
+	Compiler      string            `toml:"compiler"`
+	BuildCache    string            `toml:"buildcache"`
+	DefaultTarget string            `toml:"default_target"` // executable used by play/debug
+	Vars          map[string]string `toml:"vars"`
 }
 
 type Target struct {
-	Kind           string              `toml:"kind"`     // "executable" or "object"
-	Language       string              `toml:"language"` // "c99", "c++20"
-	Sources        []string            `toml:"sources"`
-	Includes       []string            `toml:"includes"`
-	SystemIncludes []string            `toml:"system_includes"`
-	Flags          []string            `toml:"flags"`
-	Deps           []string            `toml:"deps"`
-	Platform       map[string]Platform `toml:"platform"`
-	Debug          BuildMode           `toml:"debug"`
-	Release        BuildMode           `toml:"release"`
+	Kind           string               `toml:"kind"`          // "executable", "test", "object", "static_library", "shared_library" or "interface"
+	Language       string               `toml:"language"`      // "c99", "c++20"
+	CStandard      string               `toml:"c_standard"`    // -std for .c sources, e.g. "c11"
+	CxxStandard    string               `toml:"cxx_standard"`  // -std for C++ sources, e.g. "c++20"
+	AsmFlags       []string             `toml:"asm_flags"`     // extra flags for .S, .s and .asm sources
+	NasmFormat     string               `toml:"nasm_format"`   // "elf64" / "win64"; defaults per platform
+	PCH            string               `toml:"pch"`           // header precompiled and force-included into every source
+	Unity          bool                 `toml:"unity"`         // compile sources in batched unity files
+	UnityBatch     int                  `toml:"unity_batch"`   // sources per unity file (default 8)
+	UnityExclude   []string             `toml:"unity_exclude"` // globs of sources compiled on their own
+	Sources        []string             `toml:"sources"`
+	Includes       []string             `toml:"includes"`
+	SystemIncludes []string             `toml:"system_includes"`
+	PublicIncludes []string             `toml:"public_includes"` // also applied to dependents
+	PublicDefines  []string             `toml:"public_defines"`  // also applied to dependents
+	PublicLinks    []string             `toml:"public_links"`    // linked into every dependent
+	Flags          []string             `toml:"flags"`
+	LinkFlags      []string             `toml:"link_flags"` // passed to the link, e.g. "-Wl,--gc-sections"
+	Linker         string               `toml:"linker"`     // "mold", "lld", "gold" or "bfd", passed as -fuse-ld
+	LTO            string               `toml:"lto"`        // link-time optimization: "full" or "thin" (clang)
+	PkgConfig      []string             `toml:"pkg_config"` // packages, e.g. "sdl2" or "freetype2 >= 2.10"
+	Deps           []string             `toml:"deps"`
+	Rules          []string             `toml:"rules"`   // [[rules]] run before compiling, by name
+	Embed          []string             `toml:"embed"`   // globs of files compiled into the target as C arrays
+	Timeout        string               `toml:"timeout"` // test targets: how long a run may take, e.g. "30s" (default 60s)
+	Platform       map[string]Platform  `toml:"platform"`
+	Modes          map[string]BuildMode `toml:"modes"`         // extends the project-level mode of the same name
+	Debug          BuildMode            `toml:"debug"`         // shorthand for modes.debug
+	Release        BuildMode            `toml:"release"`       // shorthand for modes.release
+	Install        string               `toml:"install"`       // copy library artifacts here after building
+	Version        string               `toml:"version"`       // shared library version, e.g. "1.2.0"
+	Soname         string               `toml:"soname"`        // defaults to lib<name>.so.<major>
+	Visibility     string               `toml:"visibility"`    // "hidden" (default) or "default"
+	ExportDefine   string               `toml:"export_define"` // defaults to <NAME>_EXPORTS
 }
 
 type Platform struct {
 	Includes       []string `toml:"includes"`
 	SystemIncludes []string `toml:"system_includes"`
+	PublicIncludes []string `toml:"public_includes"`
+	PublicDefines  []string `toml:"public_defines"`
+	PublicLinks    []string `toml:"public_links"`
 	LibDirs        []string `toml:"libdirs"`
 	Links          []string `toml:"links"`
+	LinkFlags      []string `toml:"link_flags"`
+	PkgConfig      []string `toml:"pkg_config"`
 	Output         string   `toml:"output"`
 }
 
 type BuildMode struct {
-	Flags []string `toml:"flags"`
+	Flags     []string `toml:"flags"`
+	LinkFlags []string `toml:"link_flags"`
+}
+
+// Toolchain names the tools used for a build, typically for cross-compiling.
+// Unset tools default to the prefixed gcc/clang driver and binutils.
+type Toolchain struct {
+	Compiler string   `toml:"compiler"` // "gcc" or "clang"; defaults to the project compiler
+	CC       string   `toml:"cc"`
+	CXX      string   `toml:"cxx"`
+	AR       string   `toml:"ar"`
+	LD       string   `toml:"ld"` // linker passed as -fuse-ld, e.g. "lld" or "gold"
+	Objcopy  string   `toml:"objcopy"`
+	Strip    string   `toml:"strip"`
+	Prefix   string   `toml:"prefix"`  // target triple prefix, e.g. "aarch64-linux-gnu-"
+	Sysroot  string   `toml:"sysroot"` // passed as --sysroot to compiles and links
+	Flags    []string `toml:"flags"`   // added to every compile and link, e.g. "-march=armv8-a"
+	Runner   string   `toml:"runner"`  // runs built executables, e.g. "wine" or "qemu-aarch64"
 }
 
 type PostBuild struct {
@@ -62,6 +123,43 @@ type PostBuild struct {
 	RunWindows string   `toml:"run_windows"`
 }
 
+type Cache struct {
+	Enabled  bool        `toml:"enabled"`
+	Dir      string      `toml:"dir"`      // defaults to ~/.cache/larva
+	MaxSize  string      `toml:"max_size"` // e.g. "5G"; least recently used entries are evicted beyond it
+	Hardlink bool        `toml:"hardlink"` // hardlink hits into the build cache instead of copying
+	Remote   RemoteCache `toml:"remote"`
+}
+
+type RemoteCache struct {
+	URL      string            `toml:"url"`       // HTTP cache, e.g. a bazel-remote instance
+	ReadOnly bool              `toml:"read_only"` // download only, never upload
+	Headers  map[string]string `toml:"headers"`   // values expand ${ENV} variables
+	Timeout  string            `toml:"timeout"`   // per request, e.g. "5s" (default 10s)
+}
+
+// Rule generates files from inputs before the targets that use it compile.
+// Outputs go in the target's generated directory, which is on its include
+// path; generated sources are compiled into the target.
+type Rule struct {
+	Name    string   `toml:"name"`
+	Inputs  []string `toml:"inputs"`  // globs
+	Outputs []string `toml:"outputs"` // e.g. "shaders/{stem}.h"; {stem} runs the rule per input
+	Command string   `toml:"command"` // {in} and {out} expand to the inputs and outputs
+}
+
+// Golden is a test that runs an executable target and compares its stdout
+// with a checked-in file.
+type Golden struct {
+	Name     string   `toml:"name"` // defaults to <target>:<expected file stem>
+	Target   string   `toml:"target"`
+	Args     []string `toml:"args"`
+	Stdin    string   `toml:"stdin"`     // file fed to stdin
+	Expected string   `toml:"expected"`  // expected stdout; rewritten by larva test --update
+	ExitCode int      `toml:"exit_code"` // expected exit status (default 0)
+	Timeout  string   `toml:"timeout"`   // default 60s
+}
+
 type Command struct {
 	Description string   `toml:"description"`
 	Steps       []string `toml:"steps"`
@@ -74,80 +172,183 @@ const version = "0.1.0"
 
 var (
 	cfg      Config
-	plat     string
-	mode     string // "debug" or "release"
+	plat     string // target platform: the host's, or --platform
+	host     string // platform larva is running on
+	mode     string // build mode: "debug", "release" or a named mode (--mode)
 	buildDir string
 	cacheDir string
+	jobs     int  // parallel compile jobs (-j)
+	explain  bool // print why each object is rebuilt (--explain)
+	unity    bool // force unity builds for every target (--unity)
+
+	sanitizers []string // sanitizers instrumenting compile and link (--sanitize)
+
+	toolchain string    // selected [toolchains.<name>] (--toolchain), "" for the host compiler
+	tc        Toolchain // the selected toolchain's definition
+
+	junitPath string // larva test: write a JUnit XML report here (--junit)
+	jsonPath  string // larva test: write a JSON report here (--json)
+	update    bool   // larva test: rewrite golden files instead of comparing (--update)
 )
 
 func main() {
 	// Handle flags that don't need a config file
 	cmd := "build"
-	mode = "debug"
-	if len(os.Args) > 1 {
-		cmd = os.Args[1]
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "--version", "-v":
+			fmt.Printf("%s v%s\n", teal("larva"), version)
+			return
+		case "--help", "-h", "help":
+			printHelp()
+			return
+		}
+		if !strings.HasPrefix(args[0], "-") {
+			cmd = args[0]
+			args = args[1:]
+		}
 	}
 
-	switch cmd {
-	case "--version", "-v":
-		fmt.Printf("%s v%s\n", teal("larva"), version)
-		return
-	case "--help", "-h", "help":
-		printHelp()
-		return
-	}
+	targetArgs := parseFlags(args)
 
-	// Parse config
-	if _, err := toml.DecodeFile("larva.toml", &cfg); err != nil {
+	// Parse config. The cache command also works outside a project.
+	if _, err := toml.DecodeFile("larva.toml", &cfg); err != nil && !(cmd == "cache" && os.IsNotExist(err)) {
 		printError("error:", err)
 		os.Exit(1)
 	}
 
-	// Detect platform
+	// Detect platform. --platform picks another one to cross-compile for.
 	if runtime.GOOS == "windows" {
-		plat = "windows"
+		host = "windows"
 	} else {
-		plat = "linux"
+		host = "linux"
+	}
+	if plat == "" {
+		plat = host
+	}
+	if plat != "linux" && plat != "windows" {
+		printError("error:", "unknown platform '"+plat+"' (have linux, windows)")
+		os.Exit(1)
 	}
 
+	// release is shorthand for --mode release, so it can't take another mode
 	if cmd == "release" {
+		if mode != "" && mode != "release" {
+			printError("error:", "release conflicts with --mode "+mode+"; use larva build --mode "+mode)
+			os.Exit(1)
+		}
 		mode = "release"
 		cmd = "build"
 	}
+	if mode == "" {
+		mode = "debug"
+	}
+	if !knownMode(mode) {
+		printError("error:", "unknown mode '"+mode+"' (have "+strings.Join(buildModes(), ", ")+")")
+		os.Exit(1)
+	}
+	if toolchain != "" {
+		t, ok := cfg.Toolchains[toolchain]
+		if !ok {
+			printError("error:", "undefined toolchain '"+toolchain+"'")
+			os.Exit(1)
+		}
+		tc = t
+	} else if plat == "windows" && host != "windows" {
+		// Cross-compile for Windows with MinGW unless a toolchain was chosen
+		toolchain = "mingw"
+		tc = Toolchain{Prefix: "x86_64-w64-mingw32-"}
+		if t, ok := cfg.Toolchains["mingw"]; ok {
+			tc = t
+		}
+	}
+	if err := checkSanitizers(sanitizers); err != nil {
+		printError("error:", err)
+		os.Exit(1)
+	}
+	for _, name := range sortedTargets() {
+		t := cfg.Targets[name]
+		if err := checkLinkOptions(name, t); err != nil {
+			printError("error:", err)
+			os.Exit(1)
+		}
+		for _, spec := range append(append([]string{}, t.PkgConfig...), t.Platform[plat].PkgConfig...) {
+			if strings.TrimSpace(spec) == "" {
+				printError("error:", "target '"+name+"' has an empty pkg_config entry")
+				os.Exit(1)
+			}
+		}
+		for _, r := range t.Rules {
+			if _, ok := findRule(r); !ok {
+				printError("error:", "target '"+name+"' uses undefined rule '"+r+"'")
+				os.Exit(1)
+			}
+		}
+	}
 
-	// Resolve build dir from the main executable target
-	for _, t := range cfg.Targets {
-		if t.Kind == "executable" {
-			if p, ok := t.Platform[plat]; ok && p.Output != "" {
-				buildDir = p.Output
+	// Resolve build dir from the default executable target, falling back to
+	// the first executable (sorted by name) that declares an output dir
+	outputRoot := ""
+	if p, ok := cfg.Targets[defaultTarget()].Platform[plat]; ok && p.Output != "" {
+		outputRoot = p.Output
+	} else {
+		first := ""
+		for _, name := range sortedTargets() {
+			t := cfg.Targets[name]
+			p, ok := t.Platform[plat]
+			if !ok || t.Kind != "executable" || p.Output == "" {
+				continue
+			}
+			if outputRoot == "" {
+				outputRoot, first = p.Output, name
+			} else if cfg.Project.BuildCache == "" && filepath.Clean(p.Output) != filepath.Clean(outputRoot) {
+				// Without a buildcache the objects follow the build dir
+				printError("warning:", "executables "+first+" and "+name+" declare different output dirs; objects go under "+first+"'s, set default_target or buildcache to choose")
 				break
 			}
 		}
 	}
 
-	// Resolve cache dir for object files (defaults to buildDir if not set)
-	cacheDir = cfg.Project.BuildCache
-	if cacheDir == "" {
-		cacheDir = buildDir
+	// Each platform/compiler/mode combination gets its own subdirectory so
+	// switching between them stays incremental
+	buildDir = filepath.Join(outputRoot, variantName(plat, mode))
+
+	// Resolve cache dir for object files. Without a buildcache they go in an
+	// obj/ subdirectory of the output dir, clear of the linked executables.
+	if cfg.Project.BuildCache != "" {
+		cacheDir = filepath.Join(cfg.Project.BuildCache, variantName(plat, mode))
+	} else {
+		cacheDir = filepath.Join(buildDir, "obj")
+	}
+
+	if cfg.Cache.Enabled {
+		objCache = newObjectCache(cfg.Cache)
 	}
 
 	switch cmd {
 	case "build":
-		doBuild()
+		doBuild(targetArgs)
 	case "play":
-		doBuild()
-		doExec()
+		exe := runTarget(targetArgs)
+		doBuild([]string{exe})
+		doExec(exe)
 	case "debug":
-		doBuild()
-		doDebug()
+		exe := runTarget(targetArgs)
+		doBuild([]string{exe})
+		doDebug(exe)
 	case "assets":
-		doPostBuild()
+		doPostBuild(nil)
 	case "clean":
 		doClean()
 	case "vs":
 		doGenerateVS()
 	case "lsp":
 		doGenerateCompileCommands()
+	case "cache":
+		doCache(targetArgs)
+	case "test":
+		doTest(targetArgs)
 	default:
 		// Check custom commands
 		if c, ok := cfg.Commands[cmd]; ok {
@@ -160,111 +361,541 @@ func main() {
 
 // --- Build logic ---
 
-func doBuild() {
+// doBuild builds the named targets, or every target except tests when none
+// are given.
+func doBuild(selected []string) {
 	buildStart := time.Now()
 	os.MkdirAll(buildDir, 0o755)
 	os.MkdirAll(cacheDir, 0o755)
 
-	// Build all targets in dependency order
+	roots := selected
+	if len(roots) == 0 {
+		for _, name := range sortedTargets() {
+			if cfg.Targets[name].Kind != "test" {
+				roots = append(roots, name)
+			}
+		}
+	}
+
+	order, err := buildOrder(roots)
+	if err != nil {
+		printError("error:", err)
+		os.Exit(1)
+	}
+
+	// Collect compile jobs for every target so independent translation
+	// units can run concurrently
 	built := map[string][]string{} // target name -> object files
-	mainTarget := ""
+	var pending []compileJob
+	for _, name := range order {
+		runRules(name, cfg.Targets[name])
+		generateEmbed(name, cfg.Targets[name])
+		objects, jobs := buildTarget(name, cfg.Targets[name])
+		built[name] = objects
+		pending = append(pending, jobs...)
+	}
 
-	// Find the executable target
-	for name, t := range cfg.Targets {
-		if t.Kind == "executable" {
-			mainTarget = name
+	// Precompiled headers first, since the sources using them depend on them
+	var pchJobs, sourceJobs []compileJob
+	for _, job := range pending {
+		if job.pch {
+			pchJobs = append(pchJobs, job)
+		} else {
+			sourceJobs = append(sourceJobs, job)
 		}
 	}
-
-	// Build dependencies first, then main
-	if mainTarget != "" {
-		t := cfg.Targets[mainTarget]
-		for _, dep := range t.Deps {
-			built[dep] = buildTarget(dep, cfg.Targets[dep])
+	for _, batch := range [][]compileJob{pchJobs, sourceJobs} {
+		if err := runJobs(batch); err != nil {
+			objCache.finish()
+			printError("FAILED:", err)
+			os.Exit(1)
 		}
-		built[mainTarget] = buildTarget(mainTarget, t)
+	}
+	objCache.finish()
 
-		// Link
-		var allObjects []string
-		for _, dep := range t.Deps {
-			allObjects = append(allObjects, built[dep]...)
+	// Archive and link in dependency order, so every library exists before
+	// anything that links against it
+	libs := map[string]string{} // library target -> file to link against
+	for _, name := range order {
+		t := cfg.Targets[name]
+		switch t.Kind {
+		case "static_library":
+			libs[name] = archiveTarget(name, t, built[name])
+		case "shared_library":
+			inputs, rpaths := linkInputs(name, built, libs)
+			libs[name] = linkShared(name, t, append(built[name], inputs...), rpaths)
+		case "executable", "test":
+			inputs, rpaths := linkInputs(name, built, libs)
+			linkTarget(name, t, append(built[name], inputs...), rpaths)
 		}
-		allObjects = append(allObjects, built[mainTarget]...)
-		linkTarget(t, allObjects)
 	}
 
-	doPostBuild()
+	doPostBuild(order)
 	elapsed := time.Since(buildStart)
 	printSuccess(fmt.Sprintf("Build succeeded in %s.", formatDuration(elapsed)))
 }
 
-func buildTarget(name string, t Target) []string {
-	// Resolve sources (expand globs)
-	var sources []string
-	for _, pat := range t.Sources {
-		matches, _ := filepath.Glob(pat)
-		sources = append(sources, matches...)
+// sourceCommand returns the tool and leading arguments that compile a source
+// of the given language, before dependency, input and output arguments.
+func sourceCommand(t Target, lang string, flags []string) (string, []string) {
+	switch lang {
+	case "nasm":
+		// NASM takes include paths but not the C compiler's flags
+		args := []string{"-f", nasmFormat(t)}
+		for i := 0; i < len(flags)-1; i++ {
+			if flags[i] == "-I" || flags[i] == "-isystem" {
+				args = append(args, "-I", strings.TrimSuffix(flags[i+1], "/")+"/")
+				i++
+			}
+		}
+		return "nasm", append(args, t.AsmFlags...)
+	case "as":
+		compiler, _ := resolveCompiler(t, "c")
+		return compiler, append([]string{"-c"}, t.AsmFlags...)
+	case "asm":
+		// Preprocessed assembly sees the target's defines and includes
+		compiler, _ := resolveCompiler(t, "c")
+		args := append([]string{"-c"}, flags...)
+		return compiler, append(args, t.AsmFlags...)
 	}
-	if len(sources) == 0 {
-		printError("warning:", "no sources found for target '"+name+"'")
-		return nil
+
+	compiler, stdFlag := resolveCompiler(t, lang)
+	args := []string{"-c"}
+	if stdFlag != "" {
+		args = append(args, stdFlag)
 	}
+	return compiler, append(args, flags...)
+}
 
-	// Resolve includes
-	includes := t.Includes
-	systemIncludes := t.SystemIncludes
-	if p, ok := t.Platform[plat]; ok {
+func nasmFormat(t Target) string {
+	if t.NasmFormat != "" {
+		return t.NasmFormat
+	}
+	if plat == "windows" {
+		return "win64"
+	}
+	return "elf64"
+}
+
+// targetFlags resolves the compile flags shared by every source of a target:
+// its own and mode-specific flags, include paths, and the usage requirements
+// it inherits from its dependencies.
+func targetFlags(name string, t Target, platform string) []string {
+	flags := append([]string{}, t.Flags...)
+
+	for _, f := range targetMode(t, mode).Flags {
+		flags = append(flags, expandTargetVars(f, name))
+	}
+	flags = append(flags, toolchainFlags(name)...)
+	flags = append(flags, sanitizeFlags()...)
+	flags = append(flags, ltoFlags(t.LTO)...)
+
+	// Shared libraries, and the static and object targets linked into one,
+	// need position-independent code
+	if platform != "windows" && (t.Kind == "shared_library" || linkedIntoShared(name)) {
+		flags = append(flags, "-fPIC")
+	}
+
+	// Shared libraries also hide, by default, every symbol that isn't
+	// explicitly exported
+	if t.Kind == "shared_library" {
+		if t.Visibility != "default" {
+			flags = append(flags, "-fvisibility=hidden")
+		}
+		flags = append(flags, "-D"+exportDefine(name, t))
+	}
+
+	u := usageRequirements(name, platform)
+	for _, def := range u.defines {
+		flags = append(flags, "-D"+def)
+	}
+
+	includes := append([]string{}, t.Includes...)
+	systemIncludes := append([]string{}, t.SystemIncludes...)
+	if p, ok := t.Platform[platform]; ok {
 		includes = append(includes, p.Includes...)
 		systemIncludes = append(systemIncludes, p.SystemIncludes...)
 	}
+	includes = appendUnique(includes, u.includes...)
+	if len(t.Rules) > 0 || len(t.Embed) > 0 {
+		includes = append(includes, genDir(name))
+	}
+	for _, inc := range includes {
+		flags = append(flags, "-I", inc)
+	}
+	for _, inc := range systemIncludes {
+		flags = append(flags, "-isystem", inc)
+	}
+	for _, pkg := range targetPackages(name, t, platform) {
+		flags = append(flags, pkg.cflags...)
+	}
+	return flags
+}
 
-	// Resolve flags
-	var flags []string
-	if mode == "release" {
-		flags = t.Release.Flags
-	} else {
-		flags = t.Debug.Flags
+// usage holds the requirements a target imposes on everything that depends
+// on it.
+type usage struct {
+	includes []string
+	defines  []string
+	links    []string
+}
+
+// usageRequirements collects the public includes, defines and links that
+// apply to a target: its own, followed by those of its transitive
+// dependencies, dependents first.
+func usageRequirements(name, platform string) usage {
+	var u usage
+	order, err := buildOrder([]string{name})
+	if err != nil {
+		return u
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		t := cfg.Targets[order[i]]
+		u.includes = appendUnique(u.includes, t.PublicIncludes...)
+		u.defines = appendUnique(u.defines, t.PublicDefines...)
+		u.links = appendUnique(u.links, t.PublicLinks...)
+		if p, ok := t.Platform[platform]; ok {
+			u.includes = appendUnique(u.includes, p.PublicIncludes...)
+			u.defines = appendUnique(u.defines, p.PublicDefines...)
+			u.links = appendUnique(u.links, p.PublicLinks...)
+		}
+	}
+	return u
+}
+
+// compileJob is a single translation unit waiting to be compiled.
+type compileJob struct {
+	src       string
+	compiler  string
+	args      []string
+	obj       string
+	dep       string
+	sigFile   string // written after a successful compile
+	sig       string
+	pch       bool // precompiled header, built before everything else
+	cacheable bool // may be served from the object cache
+}
+
+// buildTarget returns the target's object files along with the compile jobs
+// needed to bring them up to date.
+func buildTarget(name string, t Target) ([]string, []compileJob) {
+	sources := targetSources(t)
+	for _, out := range ruleOutputs(name, t) {
+		// Only generated sources are compiled; anything else is data or headers
+		if isSourceFile(out) {
+			sources = append(sources, out)
+		}
+	}
+	if len(t.Embed) > 0 {
+		sources = append(sources, filepath.Join(genDir(name), embedBase(name)+".c"))
+	}
+	if len(sources) == 0 {
+		// Interface targets only carry usage requirements
+		if t.Kind != "interface" {
+			printError("warning:", "no sources found for target '"+name+"'")
+		}
+		return nil, nil
 	}
 
-	for i, f := range flags {
-		flags[i] = expandVars(f)
+	if t.Unity || unity {
+		sources = unitySources(name, t, sources)
 	}
 
-	// Determine compiler and standard
-	compiler, stdFlag := resolveCompiler(t.Language)
-	ext := sourceExt(t.Language)
+	flags := targetFlags(name, t, plat)
 
-	// Compile each source
 	var objects []string
+	var jobs []compileJob
+
+	// Precompile the target's header first. Sources of the same language
+	// force-include it, and all of them rebuild when it does.
+	var pchLang, pchStub, pchOut string
+	var pchRebuilt bool
+	if t.PCH != "" {
+		pchLang = pchLanguage(t)
+		var job *compileJob
+		pchStub, pchOut, job = precompileHeader(name, t, pchLang, flags)
+		if job != nil {
+			jobs = append(jobs, *job)
+			pchRebuilt = true
+		}
+	}
+
+	// Queue each source that is out of date
+	owners := map[string]string{} // object file -> source
 	for _, src := range sources {
-		obj := filepath.Join(cacheDir, strings.TrimSuffix(filepath.Base(src), ext)+".o")
+		lang := sourceLanguage(t, src)
+		if lang == "" {
+			continue // headers listed alongside sources
+		}
+		obj := objectPath(name, src)
+		if owner, ok := owners[obj]; ok {
+			if filepath.Clean(owner) == filepath.Clean(src) {
+				continue // matched by more than one glob
+			}
+			printError("error:", fmt.Sprintf("target '%s': %s and %s both compile to %s", name, owner, src, obj))
+			os.Exit(1)
+		}
+		owners[obj] = src
+		os.MkdirAll(filepath.Dir(obj), 0o755)
+
 		dep := strings.TrimSuffix(obj, ".o") + ".d"
-		if needsRecompile(src, obj, dep) {
-			args := []string{"-c", stdFlag}
-			args = append(args, t.Flags...)
+		sigFile := strings.TrimSuffix(obj, ".o") + ".sig"
+
+		compiler, args := sourceCommand(t, lang, flags)
+		if lang == pchLang {
+			args = append(args, "-include", pchStub)
+		}
+		switch lang {
+		case "nasm":
+			args = append(args, "-MD", dep)
+		case "as":
+			// No preprocessor, so nothing to track beyond the source
+		default:
 			args = append(args, "-MMD", "-MF", dep)
-			args = append(args, flags...)
-			for _, inc := range includes {
-				args = append(args, "-I", inc)
-			}
-			for _, inc := range systemIncludes {
-				args = append(args, "-isystem", inc)
+		}
+		args = append(args, src, "-o", obj)
+
+		sig := commandSignature(compiler, args)
+		rebuild, reason := needsRecompile(src, obj, dep, sigFile, sig)
+		if !rebuild && lang == pchLang && (pchRebuilt || isNewer(pchOut, obj)) {
+			rebuild, reason = true, "precompiled header changed"
+		}
+		if rebuild {
+			if explain {
+				printExplain(src, reason)
 			}
-			args = append(args, src, "-o", obj)
-			run(compiler, args...)
+			jobs = append(jobs, compileJob{
+				src: src, compiler: compiler, args: args, obj: obj, dep: dep,
+				sigFile: sigFile, sig: sig, cacheable: lang == "c" || lang == "c++" || lang == "asm",
+			})
 		} else {
-			printSkip(filepath.Base(src))
+			printSkip(src)
 		}
 		objects = append(objects, obj)
 	}
-	return objects
+	return objects, jobs
+}
+
+// unitySources groups a target's C and C++ sources into batches, writes one
+// generated unity file per batch into the cache and returns those in place of
+// the batched sources. Excluded and other sources are passed through. A unity
+// file is only rewritten when its membership changes, so untouched batches
+// stay up to date.
+func unitySources(name string, t Target, sources []string) []string {
+	batchSize := t.UnityBatch
+	if batchSize <= 0 {
+		batchSize = 8
+	}
+	excluded := map[string]bool{}
+	for _, pat := range t.UnityExclude {
+		matches, _ := filepath.Glob(pat)
+		for _, m := range matches {
+			excluded[filepath.Clean(m)] = true
+		}
+	}
+
+	var result []string
+	byLang := map[string][]string{}
+	seen := map[string]bool{}
+	for _, src := range sources {
+		lang := sourceLanguage(t, src)
+		clean := filepath.Clean(src)
+		if (lang != "c" && lang != "c++") || excluded[clean] {
+			result = append(result, src)
+			continue
+		}
+		if !seen[clean] {
+			seen[clean] = true
+			byLang[lang] = append(byLang[lang], clean)
+		}
+	}
+
+	dir := filepath.Join(cacheDir, name, "_unity")
+	os.MkdirAll(dir, 0o755)
+	for _, lang := range []string{"c++", "c"} {
+		members := byLang[lang]
+		sort.Strings(members)
+		for n := 0; n*batchSize < len(members); n++ {
+			batch := members[n*batchSize:]
+			if len(batch) > batchSize {
+				batch = batch[:batchSize]
+			}
+			var b strings.Builder
+			b.WriteString("// Generated by larva. Do not edit.\n")
+			for _, src := range batch {
+				b.WriteString("#include \"" + includePath(dir, src) + "\"\n")
+			}
+
+			file := filepath.Join(dir, fmt.Sprintf("unity_%d.cpp", n))
+			if lang == "c" {
+				file = filepath.Join(dir, fmt.Sprintf("unity_c_%d.c", n))
+			}
+			if old, err := os.ReadFile(file); err != nil || string(old) != b.String() {
+				os.WriteFile(file, []byte(b.String()), 0o644)
+			}
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+// precompileHeader prepares a target's precompiled header. It writes a stub
+// header into the cache that includes the real one, so the .gch (gcc) or .pch
+// (clang) can sit next to it where `-include <stub>` finds it. It returns the
+// stub, the precompiled output and, if that is out of date, the job to
+// rebuild it.
+func precompileHeader(name string, t Target, lang string, flags []string) (stub, out string, job *compileJob) {
+	dir := filepath.Join(cacheDir, name, "_pch")
+	os.MkdirAll(dir, 0o755)
+
+	stub = filepath.Join(dir, filepath.Base(t.PCH))
+	content := "#include \"" + includePath(dir, t.PCH) + "\"\n"
+	if old, err := os.ReadFile(stub); err != nil || string(old) != content {
+		os.WriteFile(stub, []byte(content), 0o644)
+	}
+
+	out = stub + ".gch"
+	if compilerFamily() == "clang" {
+		out = stub + ".pch"
+	}
+	dep := stub + ".d"
+	sigFile := stub + ".sig"
+
+	compiler, stdFlag := resolveCompiler(t, lang)
+	args := []string{"-x", lang + "-header"}
+	if stdFlag != "" {
+		args = append(args, stdFlag)
+	}
+	args = append(args, flags...)
+	args = append(args, "-MMD", "-MF", dep, stub, "-o", out)
+
+	sig := commandSignature(compiler, args)
+	if rebuild, reason := needsRecompile(t.PCH, out, dep, sigFile, sig); rebuild {
+		if explain {
+			printExplain(t.PCH, reason)
+		}
+		return stub, out, &compileJob{src: t.PCH, compiler: compiler, args: args, sigFile: sigFile, sig: sig, pch: true}
+	}
+	printSkip(t.PCH)
+	return stub, out, nil
+}
+
+// includePath returns how a generated file in dir should #include file. The
+// path is relative where possible, so generated files (and their preprocessed
+// output) are identical across checkouts.
+func includePath(dir, file string) string {
+	absDir, _ := filepath.Abs(dir)
+	absFile, _ := filepath.Abs(file)
+	if rel, err := filepath.Rel(absDir, absFile); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(absFile)
+}
+
+// pchLanguage decides whether a target's precompiled header is C or C++:
+// C++ header extensions are, and a plain .h is whenever the target has any
+// C++ sources.
+func pchLanguage(t Target) string {
+	switch filepath.Ext(t.PCH) {
+	case ".hpp", ".hh", ".hxx":
+		return "c++"
+	}
+	for _, src := range targetSources(t) {
+		if sourceLanguage(t, src) == "c++" {
+			return "c++"
+		}
+	}
+	return "c"
+}
+
+// runJobs compiles the given jobs on a pool of `jobs` workers. Each job's
+// output is buffered and printed as one block so lines never interleave.
+// After the first failure no new jobs are started; the ones already running
+// are waited for before the error is returned.
+func runJobs(pending []compileJob) error {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	queue := make(chan compileJob)
+	workers := jobs
+	if workers > len(pending) {
+		workers = len(pending)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				// A job handed over as another one failed is dropped too
+				mu.Lock()
+				failed := firstErr != nil
+				mu.Unlock()
+				if failed {
+					continue
+				}
+
+				var out []byte
+				var err error
+				hit := false
+				key := ""
+				if job.cacheable {
+					key = objCache.key(job)
+					hit = objCache.fetch(key, job)
+				}
+				if !hit {
+					// Never write through a hardlink into the object cache
+					os.Remove(job.obj)
+					cmd := exec.Command(job.compiler, job.args...)
+					out, err = cmd.CombinedOutput()
+					if err == nil && key != "" {
+						objCache.store(key, job)
+					}
+				}
+
+				mu.Lock()
+				if hit {
+					printCached(job.src)
+				} else {
+					printCmd(job.compiler, strings.Join(job.args, " "))
+				}
+				os.Stdout.Write(out)
+				if err == nil {
+					os.WriteFile(job.sigFile, []byte(job.sig), 0o644)
+				} else if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %v", job.src, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, job := range pending {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
 }
 
-func linkTarget(t Target, objects []string) {
-	output := filepath.Join(buildDir, exeName(cfg.Project.Name))
+func linkTarget(name string, t Target, objects, rpaths []string) {
+	dir := outputDir(name)
+	os.MkdirAll(dir, 0o755)
+	output := filepath.Join(dir, exeName(name))
 	args := make([]string, 0, len(objects)+20)
 	args = append(args, objects...)
 	args = append(args, "-o", output)
+	args = append(args, linkFlags(name, t)...)
+	for _, rpath := range rpaths {
+		args = append(args, "-Wl,-rpath,"+rpath)
+	}
 
 	if p, ok := t.Platform[plat]; ok {
 		for _, dir := range p.LibDirs {
@@ -275,114 +906,539 @@ func linkTarget(t Target, objects []string) {
 		}
 	}
 
-	compiler, _ := resolveCompiler(t.Language)
+	compiler, _ := resolveCompiler(t, linkLanguage(name))
 	run(compiler, args...)
 }
 
-func doPostBuild() {
-	for _, pb := range cfg.PostBuild {
-		// Copy files
-		for _, pat := range pb.Copy {
-			files, _ := filepath.Glob(pat)
-			copied := 0
-			for _, f := range files {
-				dst := filepath.Join(buildDir, filepath.Base(f))
-				if isNewer(f, dst) {
-					data, _ := os.ReadFile(f)
-					os.WriteFile(dst, data, 0o644)
-					copied++
-				}
+// archiveTarget bundles a static library's objects into lib<name>.a in the
+// output dir and returns its path. The archive is only rewritten when one of
+// its members is newer or the member list changed.
+func archiveTarget(name string, t Target, objects []string) string {
+	lib := filepath.Join(outputDir(name), "lib"+name+".a")
+	sigFile := filepath.Join(cacheDir, name, "lib"+name+".a.sig")
+	sig := strings.Join(objects, "\n") + "\n"
+
+	if needsArchive(lib, sigFile, sig, objects) {
+		// Recreate from scratch so removed sources don't linger as members
+		os.Remove(lib)
+		args := append([]string{"rcs", lib}, objects...)
+		run(archiver(t), args...)
+		os.WriteFile(sigFile, []byte(sig), 0o644)
+	} else {
+		printSkip(lib)
+	}
+
+	if t.Install != "" {
+		installFiles(t.Install, lib)
+	}
+	return lib
+}
+
+// linkShared links a shared library into the output dir and returns the path
+// dependents should link against: the .so itself on Linux, the import
+// library on Windows. Versioned libraries get the usual symlink chain
+// lib<name>.so -> lib<name>.so.<major> -> lib<name>.so.<version>.
+func linkShared(name string, t Target, objects, rpaths []string) string {
+	args := append([]string{"-shared"}, objects...)
+	args = append(args, linkFlags(name, t)...)
+	for _, rpath := range rpaths {
+		args = append(args, "-Wl,-rpath,"+rpath)
+	}
+
+	buildDir := outputDir(name)
+	os.MkdirAll(buildDir, 0o755)
+
+	var output, linkWith string
+	var links []string // symlinks to create, each pointing at the next
+	if plat == "windows" {
+		output = filepath.Join(buildDir, name+".dll")
+		linkWith = filepath.Join(buildDir, "lib"+name+".dll.a")
+		args = append(args, "-Wl,--out-implib,"+linkWith)
+	} else {
+		base := "lib" + name + ".so"
+		soname := t.Soname
+		if t.Version != "" {
+			output = filepath.Join(buildDir, base+"."+t.Version)
+			if soname == "" {
+				soname = base + "." + strings.SplitN(t.Version, ".", 2)[0]
 			}
-			if copied > 0 {
-				printCopied(copied, pat)
+			links = append(links, filepath.Join(buildDir, base))
+			if soname != base && soname != filepath.Base(output) {
+				links = append(links, filepath.Join(buildDir, soname))
+			}
+		} else {
+			output = filepath.Join(buildDir, base)
+			if soname == "" {
+				soname = base
 			}
 		}
+		linkWith = filepath.Join(buildDir, base)
+		args = append(args, "-Wl,-soname,"+soname)
+	}
+	args = append(args, "-o", output)
 
-		// Run platform command
-		cmdStr := ""
-		if plat == "windows" {
-			cmdStr = pb.RunWindows
-		} else {
-			cmdStr = pb.RunLinux
+	if p, ok := t.Platform[plat]; ok {
+		for _, dir := range p.LibDirs {
+			args = append(args, "-L", dir)
 		}
-		if cmdStr != "" {
-			cmdStr = expandVars(cmdStr)
-			parts := strings.Fields(cmdStr)
-			run(parts[0], parts[1:]...)
+		for _, link := range p.Links {
+			args = append(args, "-l"+link)
 		}
 	}
-}
 
-func doExec() {
-	exe, _ := filepath.Abs(filepath.Join(buildDir, exeName(cfg.Project.Name)))
-	dir, _ := filepath.Abs(buildDir)
-	printRunning(exe)
-	cmd := exec.Command(exe)
-	cmd.Dir = dir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	cmd.Run()
-}
+	compiler, _ := resolveCompiler(t, linkLanguage(name))
+	run(compiler, args...)
 
-func doDebug() {
-	exe, _ := filepath.Abs(filepath.Join(buildDir, exeName(cfg.Project.Name)))
-	dir, _ := filepath.Abs(buildDir)
-	printRunning("gdb " + exe)
-	cmd := exec.Command("gdb", "-tui", "-ex", "break main", "-ex", "run", exe)
-	cmd.Dir = dir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	cmd.Run()
+	// Create the symlinks, pointing each at the next one down the chain
+	for i, link := range links {
+		target := filepath.Base(output)
+		if i+1 < len(links) {
+			target = filepath.Base(links[i+1])
+		}
+		os.Remove(link)
+		os.Symlink(target, link)
+	}
+
+	if t.Install != "" {
+		installed := append([]string{output}, links...)
+		if plat == "windows" {
+			installed = append(installed, linkWith)
+		}
+		installFiles(t.Install, installed...)
+	}
+	return linkWith
 }
 
-func doClean() {
-	if c, ok := cfg.Commands["clean"]; ok {
-		for _, dir := range c.Remove {
-			os.RemoveAll(dir)
-			printRemoved(dir)
+// installFiles copies library artifacts into dir, skipping files that are
+// already up to date. Symlinks are recreated rather than followed.
+func installFiles(dir string, files ...string) {
+	os.MkdirAll(dir, 0o755)
+	for _, f := range files {
+		dst := filepath.Join(dir, filepath.Base(f))
+		if target, err := os.Readlink(f); err == nil {
+			if cur, err := os.Readlink(dst); err != nil || cur != target {
+				os.Remove(dst)
+				os.Symlink(target, dst)
+				printInstalled(dst)
+			}
+			continue
+		}
+		if isNewer(f, dst) {
+			data, _ := os.ReadFile(f)
+			perm := os.FileMode(0o644)
+			if info, err := os.Stat(f); err == nil {
+				perm = info.Mode().Perm()
+			}
+			os.WriteFile(dst, data, perm)
+			printInstalled(dst)
 		}
 	}
-	printSuccess("Cleaned.")
 }
 
-func doCommand(c Command) {
-	for _, step := range c.Steps {
-		switch {
-		case step == "build":
-			doBuild()
-		case step == "post_build":
-			doPostBuild()
-		case strings.HasPrefix(step, "exec:"):
+// linkInputs returns the objects and libraries a target links against, taken
+// from its transitive dependencies and public links, along with the run paths needed to find
+// shared libraries. Dependencies of a shared library are already linked into
+// it, so they are not repeated.
+func linkInputs(name string, built map[string][]string, libs map[string]string) (inputs, rpaths []string) {
+	for _, dep := range linkOrder(name) {
+		switch cfg.Targets[dep].Kind {
+		case "static_library":
+			inputs = append(inputs, libs[dep])
+		case "shared_library":
+			inputs = append(inputs, libs[dep])
+			if plat != "windows" {
+				rpaths = appendUnique(rpaths, rpathTo(outputDir(name), outputDir(dep)))
+			}
+		default:
+			inputs = append(inputs, built[dep]...)
+		}
+	}
+	for _, link := range usageRequirements(name, plat).links {
+		inputs = append(inputs, "-l"+link)
+	}
+
+	// pkg-config libs of the target and of everything linked into it
+	for _, n := range append([]string{name}, linkOrder(name)...) {
+		t := cfg.Targets[n]
+		if n != name && t.Kind == "shared_library" {
+			continue
+		}
+		for _, pkg := range targetPackages(n, t, plat) {
+			inputs = append(inputs, pkg.libs...)
+		}
+	}
+	return inputs, rpaths
+}
+
+// linkedIntoShared reports whether a static library or object target ends up
+// linked into some shared library.
+func linkedIntoShared(name string) bool {
+	if k := cfg.Targets[name].Kind; k != "static_library" && k != "object" {
+		return false
+	}
+	for _, lib := range sortedTargets() {
+		if cfg.Targets[lib].Kind == "shared_library" && contains(linkOrder(lib), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkOrder lists the transitive dependencies of a target with dependents
+// before their dependencies, the order static linking requires. It does not
+// descend below shared libraries.
+func linkOrder(name string) []string {
+	var post []string
+	visited := map[string]bool{}
+	var visit func(n string)
+	visit = func(n string) {
+		if visited[n] {
+			return
+		}
+		visited[n] = true
+		if n == name || cfg.Targets[n].Kind != "shared_library" {
+			for _, dep := range cfg.Targets[n].Deps {
+				visit(dep)
+			}
+		}
+		post = append(post, n)
+	}
+	visit(name)
+
+	// Reverse post-order, without the target itself
+	order := make([]string, 0, len(post)-1)
+	for i := len(post) - 2; i >= 0; i-- {
+		order = append(order, post[i])
+	}
+	return order
+}
+
+// rpathTo returns the $ORIGIN-relative run path from an executable in exeDir
+// to libraries in libDir.
+func rpathTo(exeDir, libDir string) string {
+	absExe, _ := filepath.Abs(exeDir)
+	absLib, _ := filepath.Abs(libDir)
+	rel, err := filepath.Rel(absExe, absLib)
+	if err != nil {
+		return absLib
+	}
+	if rel == "." {
+		return "$ORIGIN"
+	}
+	return "$ORIGIN/" + filepath.ToSlash(rel)
+}
+
+func exportDefine(name string, t Target) string {
+	if t.ExportDefine != "" {
+		return t.ExportDefine
+	}
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name)) + "_EXPORTS"
+}
+
+func needsArchive(lib, sigFile, sig string, objects []string) bool {
+	old, err := os.ReadFile(sigFile)
+	if err != nil || string(old) != sig {
+		return true
+	}
+	for _, obj := range objects {
+		if isNewer(obj, lib) {
+			return true
+		}
+	}
+	return false
+}
+
+// doPostBuild runs the post-build steps belonging to the given targets, plus
+// those not tied to any target. A nil list runs every step.
+func doPostBuild(targets []string) {
+	for _, pb := range cfg.PostBuild {
+		if targets != nil && pb.Target != "" && !contains(targets, pb.Target) {
+			continue
+		}
+		outDir := buildDir
+		if pb.Target != "" {
+			outDir = outputDir(pb.Target)
+		}
+
+		// Copy files
+		for _, pat := range pb.Copy {
+			pat = expandTargetVars(pat, pb.Target)
+			files, _ := filepath.Glob(pat)
+			copied := 0
+			for _, f := range files {
+				dst := filepath.Join(outDir, filepath.Base(f))
+				if isNewer(f, dst) {
+					data, _ := os.ReadFile(f)
+					os.WriteFile(dst, data, 0o644)
+					copied++
+				}
+			}
+			if copied > 0 {
+				printCopied(copied, pat)
+			}
+		}
+
+		// Run platform command
+		cmdStr := ""
+		if plat == "windows" {
+			cmdStr = pb.RunWindows
+		} else {
+			cmdStr = pb.RunLinux
+		}
+		if cmdStr != "" {
+			cmdStr = expandTargetVars(cmdStr, pb.Target)
+			parts := strings.Fields(cmdStr)
+			// Steps written for another platform go through its runner
+			if plat != host {
+				parts = append(runner(), parts...)
+			}
+			run(parts[0], parts[1:]...)
+		}
+	}
+}
+
+func doExec(name string) {
+	exe, _ := filepath.Abs(filepath.Join(outputDir(name), exeName(name)))
+	dir, _ := filepath.Abs(outputDir(name))
+	printRunning(exe)
+	cmd := runnerCommand(exe)
+	cmd.Dir = dir
+	cmd.Env = sanitizerEnv()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	cmd.Run()
+}
+
+// runner returns the command line that runs executables built for the
+// target platform: the toolchain's runner, wine when cross-compiling for
+// Windows, or nothing when they run natively.
+func runner() []string {
+	if tc.Runner != "" {
+		return strings.Fields(tc.Runner)
+	}
+	if plat == "windows" && host != "windows" {
+		return []string{"wine"}
+	}
+	return nil
+}
+
+// runnerCommand prepares exe to run, through the runner if there is one.
+func runnerCommand(exe string, args ...string) *exec.Cmd {
+	if r := runner(); len(r) > 0 {
+		return exec.Command(r[0], append(append(r[1:], exe), args...)...)
+	}
+	return exec.Command(exe, args...)
+}
+
+func doDebug(name string) {
+	exe, _ := filepath.Abs(filepath.Join(outputDir(name), exeName(name)))
+	dir, _ := filepath.Abs(outputDir(name))
+	if plat != host {
+		printError("error:", "can't debug a "+plat+" executable on "+host)
+		os.Exit(1)
+	}
+	printRunning("gdb " + exe)
+	cmd := exec.Command("gdb", "-tui", "-ex", "break main", "-ex", "run", exe)
+	cmd.Dir = dir
+	cmd.Env = sanitizerEnv()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	cmd.Run()
+}
+
+// runTarget picks the executable for play/debug: the one named on the
+// command line, the project's default_target, or the only executable.
+func runTarget(targetArgs []string) string {
+	name := ""
+	if len(targetArgs) > 0 {
+		name = targetArgs[0]
+	} else {
+		name = defaultTarget()
+	}
+	if name == "" {
+		printError("error:", "multiple executable targets; pass a target name or set default_target")
+		os.Exit(1)
+	}
+	if _, ok := cfg.Targets[name]; !ok {
+		printError("error:", "undefined target '"+name+"'")
+		os.Exit(1)
+	}
+	if cfg.Targets[name].Kind != "executable" {
+		printError("error:", "target '"+name+"' is not an executable")
+		os.Exit(1)
+	}
+	return name
+}
+
+// defaultTarget returns the project's default_target, or the only executable
+// target if there is exactly one. Otherwise it returns "".
+func defaultTarget() string {
+	if cfg.Project.DefaultTarget != "" {
+		if _, ok := cfg.Targets[cfg.Project.DefaultTarget]; !ok {
+			printError("error:", "default_target '"+cfg.Project.DefaultTarget+"' is not defined")
+			os.Exit(1)
+		}
+		return cfg.Project.DefaultTarget
+	}
+	var exes []string
+	for _, name := range sortedTargets() {
+		if cfg.Targets[name].Kind == "executable" {
+			exes = append(exes, name)
+		}
+	}
+	if len(exes) == 1 {
+		return exes[0]
+	}
+	return ""
+}
+
+// outputDir returns where a target's artifacts go: its own platform output
+// dir if it declares one, otherwise the project's build dir.
+func outputDir(name string) string {
+	if p, ok := cfg.Targets[name].Platform[plat]; ok && p.Output != "" {
+		return filepath.Join(p.Output, variantName(plat, mode))
+	}
+	return buildDir
+}
+
+func sortedTargets() []string {
+	names := make([]string, 0, len(cfg.Targets))
+	for name := range cfg.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func doClean() {
+	if c, ok := cfg.Commands["clean"]; ok {
+		for _, dir := range c.Remove {
+			os.RemoveAll(dir)
+			printRemoved(dir)
+		}
+	}
+	printSuccess("Cleaned.")
+}
+
+func doCommand(c Command) {
+	for _, step := range c.Steps {
+		switch {
+		case step == "build":
+			doBuild(nil)
+		case step == "post_build":
+			doPostBuild(nil)
+		case strings.HasPrefix(step, "exec:"):
 			p := strings.TrimPrefix(step, "exec:")
 			p = expandVars(p)
 			absPath, _ := filepath.Abs(p)
 			absDir, _ := filepath.Abs(buildDir)
-			cmd := exec.Command(absPath)
+			cmd := runnerCommand(absPath)
 			cmd.Dir = absDir
+			cmd.Env = sanitizerEnv()
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
 			cmd.Stdin = os.Stdin
-			cmd.Run()
+			if err := cmd.Run(); err != nil {
+				printError("FAILED:", p+": "+err.Error())
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+// parseFlags handles the flags that may follow a command and returns the
+// remaining positional arguments.
+func parseFlags(args []string) []string {
+	jobs = runtime.NumCPU()
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "-j" || a == "--jobs":
+			jobs = parseJobs(flagValue(args, &i))
+		case strings.HasPrefix(a, "-j"):
+			jobs = parseJobs(a[2:])
+		case a == "--explain":
+			explain = true
+		case a == "--unity":
+			unity = true
+		case a == "--mode":
+			mode = flagValue(args, &i)
+		case strings.HasPrefix(a, "--mode="):
+			mode = strings.TrimPrefix(a, "--mode=")
+		case a == "--platform":
+			plat = flagValue(args, &i)
+		case strings.HasPrefix(a, "--platform="):
+			plat = strings.TrimPrefix(a, "--platform=")
+		case a == "--junit":
+			junitPath = flagValue(args, &i)
+		case a == "--json":
+			jsonPath = flagValue(args, &i)
+		case a == "--update":
+			update = true
+		case a == "--toolchain":
+			toolchain = flagValue(args, &i)
+		case strings.HasPrefix(a, "--toolchain="):
+			toolchain = strings.TrimPrefix(a, "--toolchain=")
+		case a == "--sanitize":
+			sanitizers = parseSanitizers(flagValue(args, &i))
+		case strings.HasPrefix(a, "--sanitize="):
+			sanitizers = parseSanitizers(strings.TrimPrefix(a, "--sanitize="))
+		default:
+			positional = append(positional, a)
 		}
 	}
+	return positional
+}
+
+// flagValue returns the argument following the flag at args[*i] and advances i.
+func flagValue(args []string, i *int) string {
+	if *i+1 >= len(args) {
+		printError("error:", "missing value for "+args[*i])
+		os.Exit(1)
+	}
+	*i++
+	return args[*i]
+}
+
+func parseJobs(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		printError("error:", "invalid job count '"+s+"'")
+		os.Exit(1)
+	}
+	return n
 }
 
 func printHelp() {
 	fmt.Printf("%s v%s - a simple C/C++ build system\n\n", teal("larva"), version)
-	fmt.Printf("Usage: %s [command]\n\n", teal("larva"))
+	fmt.Printf("Usage: %s [command] [target...] [flags]\n\n", teal("larva"))
 	fmt.Printf("Commands:\n")
-	fmt.Printf("  %s      Debug build (default)\n", teal("build"))
+	fmt.Printf("  %s      Debug build of all targets, or only the named ones (default)\n", teal("build"))
 	fmt.Printf("  %s    Optimized release build\n", teal("release"))
+	fmt.Printf("  %s       Build and run an executable (named, or default_target)\n", teal("play"))
 	fmt.Printf("  %s      Build and launch gdb with a breakpoint at main\n", teal("debug"))
 	fmt.Printf("  %s      Remove build artifacts\n", teal("clean"))
 	fmt.Printf("  %s         Generate Visual Studio NMake solution\n", teal("vs"))
 	fmt.Printf("  %s        Generate compile_commands.json for LSP\n", teal("lsp"))
+	fmt.Printf("  %s      Show (stats) or empty (clear) the object cache\n", teal("cache"))
+	fmt.Printf("  %s       Build and run test targets, optionally matching patterns\n", teal("test"))
 	fmt.Printf("\n")
 	fmt.Printf("Flags:\n")
-	fmt.Printf("  %s     Show this help message\n", teal("--help"))
-	fmt.Printf("  %s  Show version\n", teal("--version"))
+	fmt.Printf("  %s           Run N compile jobs in parallel (default: CPU count)\n", teal("-j N"))
+	fmt.Printf("  %s      Print the reason each object is rebuilt\n", teal("--explain"))
+	fmt.Printf("  %s        Compile every target as batched unity files\n", teal("--unity"))
+	fmt.Printf("  %s       Build in a named mode from [modes] (default: debug)\n", teal("--mode M"))
+	fmt.Printf("  %s   Instrument with sanitizers, e.g. address,undefined\n", teal("--sanitize S"))
+	fmt.Printf("  %s  Build with a [toolchains] entry, e.g. for cross-compiling\n", teal("--toolchain T"))
+	fmt.Printf("  %s   Build for linux or windows (MinGW when cross-compiling)\n", teal("--platform P"))
+	fmt.Printf("  %s      Write a JUnit XML report of larva test to F\n", teal("--junit F"))
+	fmt.Printf("  %s       Write a JSON report of larva test to F\n", teal("--json F"))
+	fmt.Printf("  %s       Rewrite the expected files of golden tests\n", teal("--update"))
+	fmt.Printf("  %s         Show this help message\n", teal("--help"))
+	fmt.Printf("  %s      Show version\n", teal("--version"))
 	fmt.Printf("\n")
 	fmt.Printf("Additional commands are defined in larva.toml under [commands].\n")
 }
@@ -394,6 +1450,7 @@ func printUsage() {
 	fmt.Printf("  %s    Optimized release build\n", teal("release"))
 	fmt.Printf("  %s         Generate Visual Studio solution\n", teal("vs"))
 	fmt.Printf("  %s        Generate compile_commands.json for LSP\n", teal("lsp"))
+	fmt.Printf("  %s       Build and run test targets\n", teal("test"))
 	for name, c := range cfg.Commands {
 		fmt.Printf("  %s %s\n", teal(fmt.Sprintf("%-10s", name)), c.Description)
 	}
@@ -404,12 +1461,12 @@ func printUsage() {
 // --- Colors (256-color ANSI) ---
 
 const (
-	colorReset   = "\033[0m"
-	colorTeal    = "\033[38;5;37m"  // main larva color — green/blue teal
-	colorDim     = "\033[38;5;245m" // dimmed default prints
-	colorBright  = "\033[38;5;48m"  // bright green for success
-	colorErr     = "\033[38;5;208m" // orange-red for errors
-	colorBold    = "\033[1m"
+	colorReset  = "\033[0m"
+	colorTeal   = "\033[38;5;37m"  // main larva color — green/blue teal
+	colorDim    = "\033[38;5;245m" // dimmed default prints
+	colorBright = "\033[38;5;48m"  // bright green for success
+	colorErr    = "\033[38;5;208m" // orange-red for errors
+	colorBold   = "\033[1m"
 )
 
 func teal(s string) string   { return colorTeal + s + colorReset }
@@ -417,164 +1474,1931 @@ func dim(s string) string    { return colorDim + s + colorReset }
 func bright(s string) string { return colorBold + colorBright + s + colorReset }
 func errclr(s string) string { return colorBold + colorErr + s + colorReset }
 
-// --- Print functions ---
+// --- Print functions ---
+
+func printSkip(file string) {
+	fmt.Printf("  %s %s\n", dim("skip"), dim(file))
+}
+
+func printExplain(file, reason string) {
+	fmt.Printf("  %s %s %s\n", teal("rebuild"), file, dim("("+reason+")"))
+}
+
+func printCached(file string) {
+	fmt.Printf("  %s %s\n", teal("cached"), file)
+}
+
+func printCopied(count int, pattern string) {
+	fmt.Printf("  %s %d file(s) matching %s\n", teal("copied"), count, pattern)
+}
+
+func printEmbedded(count int, path string) {
+	fmt.Printf("  %s %d file(s) into %s\n", teal("embedded"), count, path)
+}
+
+// printTestResult prints one test outcome, followed by the captured output
+// of tests that didn't pass.
+func printTestResult(r testResult) {
+	duration := dim("(" + formatDuration(r.Duration) + ")")
+	if r.Status == "pass" {
+		if r.Message != "" {
+			duration += " " + dim(r.Message)
+		}
+		fmt.Printf("  %s %s %s\n", bright("pass"), r.Name, duration)
+		return
+	}
+	fmt.Printf("  %s %s %s %s\n", errclr(r.Status), r.Name, duration, dim(r.Message))
+	for _, line := range strings.Split(strings.TrimRight(r.Output, "\n"), "\n") {
+		if line != "" {
+			fmt.Printf("      %s\n", line)
+		}
+	}
+}
+
+func printInstalled(path string) {
+	fmt.Printf("  %s %s\n", teal("installed"), path)
+}
+
+func printRunning(exe string) {
+	fmt.Printf("  %s %s\n", teal("running"), exe)
+}
+
+func printRemoved(dir string) {
+	fmt.Printf("  %s %s\n", teal("removed"), dir)
+}
+
+func printSuccess(msg string) {
+	fmt.Println(bright(msg))
+}
+
+func printError(msg string, detail interface{}) {
+	fmt.Fprintf(os.Stderr, "%s %v\n", errclr(msg), detail)
+}
+
+func printCmd(name string, args string) {
+	fmt.Printf("  %s %s\n", teal(name), dim(args))
+}
+
+// --- Helpers ---
+
+// resolveCompiler returns the compiler driver and -std flag for sources of
+// the given language ("c" or "c++") in a target. The flag is empty when the
+// target sets no standard for that language.
+func resolveCompiler(t Target, lang string) (compiler, stdFlag string) {
+	std := t.CStandard
+	if lang == "c++" {
+		std = t.CxxStandard
+	}
+	if std == "" && languageFamily(t.Language) == lang {
+		std = t.Language
+	}
+	if std != "" {
+		stdFlag = "-std=" + std
+	}
+
+	if lang == "c++" {
+		return tool("cxx"), stdFlag
+	}
+	return tool("cc"), stdFlag
+}
+
+// compilerFamily returns "gcc" or "clang" for the selected toolchain, or the
+// project compiler when none is selected.
+func compilerFamily() string {
+	if tc.Compiler != "" {
+		return tc.Compiler
+	}
+	if cfg.Project.Compiler == "clang" {
+		return "clang"
+	}
+	return "gcc"
+}
+
+// tool resolves one of cc, cxx, ar, objcopy or strip: the toolchain's explicit
+// setting, or the default for the compiler family behind the toolchain prefix.
+func tool(name string) string {
+	explicit := map[string]string{"cc": tc.CC, "cxx": tc.CXX, "ar": tc.AR, "objcopy": tc.Objcopy, "strip": tc.Strip}
+	if explicit[name] != "" {
+		return explicit[name]
+	}
+	defaults := map[string]string{"cc": "gcc", "cxx": "g++", "ar": "ar", "objcopy": "objcopy", "strip": "strip"}
+	if compilerFamily() == "clang" {
+		defaults["cc"], defaults["cxx"] = "clang", "clang++"
+	}
+	return tc.Prefix + defaults[name]
+}
+
+// toolchainFlags returns the toolchain's sysroot and extra flags, applied to
+// every compile and link of target.
+func toolchainFlags(target string) []string {
+	var flags []string
+	if tc.Sysroot != "" {
+		flags = append(flags, "--sysroot="+tc.Sysroot)
+	}
+	for _, f := range tc.Flags {
+		flags = append(flags, expandTargetVars(f, target))
+	}
+	return flags
+}
+
+// linkFlags returns everything a target's link needs beyond its inputs:
+// toolchain and linker selection, sanitizers, LTO, the mode's compile flags
+// (so e.g. -fsanitize or -flto in a mode reach the linker) and the link_flags
+// set on the mode, target and platform.
+func linkFlags(name string, t Target) []string {
+	flags := toolchainFlags(name)
+	linker := tc.LD
+	if t.Linker != "" {
+		linker = t.Linker
+	}
+	if linker != "" {
+		flags = append(flags, "-fuse-ld="+linker)
+	}
+	flags = append(flags, sanitizeFlags()...)
+	flags = append(flags, ltoFlags(linkLTO(name))...)
+
+	m := targetMode(t, mode)
+	for _, f := range append(m.Flags, m.LinkFlags...) {
+		flags = append(flags, expandTargetVars(f, name))
+	}
+	for _, f := range t.LinkFlags {
+		flags = append(flags, expandTargetVars(f, name))
+	}
+	for _, f := range t.Platform[plat].LinkFlags {
+		flags = append(flags, expandTargetVars(f, name))
+	}
+	return flags
+}
+
+// checkLinkOptions validates a target's linker and lto settings.
+func checkLinkOptions(name string, t Target) error {
+	switch t.Linker {
+	case "", "mold", "lld", "gold", "bfd":
+	default:
+		return fmt.Errorf("target '%s': unknown linker '%s' (have mold, lld, gold, bfd)", name, t.Linker)
+	}
+	switch t.LTO {
+	case "", "full":
+	case "thin":
+		if compilerFamily() != "clang" {
+			return fmt.Errorf("target '%s': lto = \"thin\" requires compiler = \"clang\"", name)
+		}
+	default:
+		return fmt.Errorf("target '%s': unknown lto '%s' (have full, thin)", name, t.LTO)
+	}
+	return nil
+}
+
+// ltoFlags returns the compile and link flags for an lto setting. GCC
+// parallelizes the link-time step across the available cores.
+func ltoFlags(lto string) []string {
+	switch {
+	case lto == "thin":
+		return []string{"-flto=thin"}
+	case lto == "full" && compilerFamily() == "gcc":
+		return []string{"-flto=auto"}
+	case lto == "full":
+		return []string{"-flto"}
+	}
+	return nil
+}
+
+// linkLTO returns the lto setting a target's link needs: its own, or that
+// of any object or static library linked into it, whose LTO objects can
+// only be linked with LTO enabled.
+func linkLTO(name string) string {
+	lto := cfg.Targets[name].LTO
+	for _, dep := range linkOrder(name) {
+		if lto == "" && cfg.Targets[dep].Kind != "shared_library" {
+			lto = cfg.Targets[dep].LTO
+		}
+	}
+	return lto
+}
+
+// archiver returns the tool that archives a static library. LTO objects
+// need the compiler's plugin-aware wrapper so the archive index covers them.
+func archiver(t Target) string {
+	if t.LTO == "" || tc.AR != "" {
+		return tool("ar")
+	}
+	if compilerFamily() == "clang" {
+		return tc.Prefix + "llvm-ar"
+	}
+	return tc.Prefix + "gcc-ar"
+}
+
+// languageFamily maps a language setting such as "c11" or "c++20" to "c" or
+// "c++".
+func languageFamily(lang string) string {
+	if strings.HasPrefix(lang, "c++") || strings.HasPrefix(lang, "gnu++") {
+		return "c++"
+	}
+	return "c"
+}
+
+// sourceLanguage picks the language a source compiles as from its extension:
+// "c", "c++", "asm" (preprocessed .S), "as" (plain .s) or "nasm" (.asm).
+// Headers return "". Unknown extensions follow the target's language.
+func sourceLanguage(t Target, src string) string {
+	switch filepath.Ext(src) {
+	case ".c":
+		return "c"
+	case ".S", ".sx":
+		return "asm"
+	case ".s":
+		return "as"
+	case ".asm":
+		return "nasm"
+	case ".cpp", ".cc", ".cxx", ".c++", ".C":
+		return "c++"
+	case ".h", ".hh", ".hpp", ".hxx", ".inl":
+		return ""
+	}
+	return languageFamily(t.Language)
+}
+
+// isSourceFile reports whether a file has an extension larva compiles, as
+// opposed to the headers and data that rules may also generate.
+func isSourceFile(path string) bool {
+	switch filepath.Ext(path) {
+	case ".c", ".S", ".sx", ".s", ".asm", ".cpp", ".cc", ".cxx", ".c++", ".C":
+		return true
+	}
+	return false
+}
+
+// linkLanguage returns "c++" when the target or anything it links contains
+// C++ sources, so the C++ driver pulls in the C++ runtime.
+func linkLanguage(name string) string {
+	order, _ := buildOrder([]string{name})
+	for _, n := range order {
+		t := cfg.Targets[n]
+		if t.CxxStandard != "" || (t.Language != "" && languageFamily(t.Language) == "c++") {
+			return "c++"
+		}
+		for _, src := range targetSources(t) {
+			if sourceLanguage(t, src) == "c++" {
+				return "c++"
+			}
+		}
+	}
+	return "c"
+}
+
+// targetSources expands a target's source globs.
+func targetSources(t Target) []string {
+	var sources []string
+	for _, pat := range t.Sources {
+		matches, _ := filepath.Glob(pat)
+		sources = append(sources, matches...)
+	}
+	return sources
+}
+
+// targetMode returns build mode m for a target: the project-level
+// [modes.<m>] defaults followed by the target's own additions.
+func targetMode(t Target, m string) BuildMode {
+	modes := []BuildMode{cfg.Modes[m], t.Modes[m]}
+	switch m {
+	case "debug":
+		modes = append(modes, t.Debug)
+	case "release":
+		modes = append(modes, t.Release)
+	}
+	var merged BuildMode
+	for _, bm := range modes {
+		merged.Flags = append(merged.Flags, bm.Flags...)
+		merged.LinkFlags = append(merged.LinkFlags, bm.LinkFlags...)
+	}
+	return merged
+}
+
+// buildModes lists every mode the config knows about: debug and release
+// first, then any named modes declared by the project or a target, sorted.
+func buildModes() []string {
+	named := map[string]bool{}
+	for m := range cfg.Modes {
+		named[m] = true
+	}
+	for _, t := range cfg.Targets {
+		for m := range t.Modes {
+			named[m] = true
+		}
+	}
+	delete(named, "debug")
+	delete(named, "release")
+	var extra []string
+	for m := range named {
+		extra = append(extra, m)
+	}
+	sort.Strings(extra)
+	return append([]string{"debug", "release"}, extra...)
+}
+
+func knownMode(m string) bool {
+	return contains(buildModes(), m)
+}
+
+// variantName names the output and cache subdirectory for a build, e.g.
+// "linux-gcc-debug": the platform, the toolchain (or compiler), the mode and
+// any sanitizers.
+func variantName(platform, buildMode string) string {
+	compiler := cfg.Project.Compiler
+	if compiler == "" {
+		compiler = "gcc"
+	}
+	if toolchain != "" {
+		compiler = toolchain
+	}
+	name := platform + "-" + compiler + "-" + buildMode
+	for _, s := range sanitizers {
+		name += "-" + sanitizerNames[s]
+	}
+	return name
+}
+
+// objectPath mirrors the source tree under the target's cache directory,
+// e.g. src/render/mesh.cpp -> <cache>/<target>/src/render/mesh.o, so sources
+// with the same base name never overwrite each other.
+func objectPath(target, src string) string {
+	rel := filepath.Clean(src)
+
+	// Generated sources already live in the cache; keep objects beside them
+	if strings.HasPrefix(rel, filepath.Clean(cacheDir)+string(filepath.Separator)) {
+		return strings.TrimSuffix(rel, filepath.Ext(rel)) + ".o"
+	}
+
+	if filepath.IsAbs(rel) {
+		cwd, _ := os.Getwd()
+		if r, err := filepath.Rel(cwd, rel); err == nil {
+			rel = r
+		} else {
+			rel = strings.TrimPrefix(rel, filepath.VolumeName(rel))
+		}
+	}
+	// Keep objects inside the cache for sources outside the project
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i, part := range parts {
+		if part == ".." {
+			parts[i] = "__"
+		}
+	}
+	rel = filepath.Join(parts...)
+	return filepath.Join(cacheDir, target, strings.TrimSuffix(rel, filepath.Ext(rel))+".o")
+}
+
+func isNewer(src, dst string) bool {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return true
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		return true
+	}
+	return srcInfo.ModTime().After(dstInfo.ModTime())
+}
+
+// needsRecompile reports whether obj is out of date, and why. Besides
+// comparing mtimes against the source and the headers listed in the .d file,
+// it compares the stored command signature so that changes to flags, mode or
+// compiler also trigger a rebuild.
+func needsRecompile(src, obj, dep, sigFile, sig string) (bool, string) {
+	objInfo, err := os.Stat(obj)
+	if err != nil {
+		return true, "no object file"
+	}
+	objTime := objInfo.ModTime()
+
+	// Check command signature
+	old, err := os.ReadFile(sigFile)
+	if err != nil {
+		return true, "no command signature"
+	}
+	oldLines := strings.SplitN(string(old), "\n", 2)
+	newLines := strings.SplitN(sig, "\n", 2)
+	if oldLines[0] != newLines[0] {
+		return true, "compiler changed"
+	}
+	if string(old) != sig {
+		return true, "command line changed"
+	}
+
+	// Check source file
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return true, "source missing"
+	}
+	if srcInfo.ModTime().After(objTime) {
+		return true, "source changed"
+	}
+
+	// Check header dependencies from .d file
+	for _, h := range parseDeps(dep) {
+		if hInfo, err := os.Stat(h); err == nil && hInfo.ModTime().After(objTime) {
+			return true, h + " changed"
+		}
+	}
+
+	return false, ""
+}
+
+// commandSignature identifies how an object was produced: the first line
+// hashes the compiler identity, the second the full command line.
+func commandSignature(compiler string, args []string) string {
+	cmdHash := sha256.Sum256([]byte(compiler + "\x00" + strings.Join(args, "\x00")))
+	return fmt.Sprintf("%x\n%x\n", compilerIdentity(compiler), cmdHash)
+}
+
+var (
+	compilerIDMu sync.Mutex
+	compilerIDs  = map[string][32]byte{}
+)
+
+// compilerIdentity hashes the resolved path and `--version` output of a
+// compiler. Results are memoized for the lifetime of the process.
+func compilerIdentity(compiler string) [32]byte {
+	compilerIDMu.Lock()
+	defer compilerIDMu.Unlock()
+	if id, ok := compilerIDs[compiler]; ok {
+		return id
+	}
+	path, _ := exec.LookPath(compiler)
+	out, _ := exec.Command(compiler, "--version").Output()
+	id := sha256.Sum256(append([]byte(path+"\x00"), out...))
+	compilerIDs[compiler] = id
+	return id
+}
+
+func parseDeps(depFile string) []string {
+	data, err := os.ReadFile(depFile)
+	if err != nil {
+		return nil
+	}
+
+	// .d format: "target: dep1 dep2 dep3 ..."
+	// Continuations use backslash-newline
+	content := strings.ReplaceAll(string(data), "\\\n", " ")
+	content = strings.ReplaceAll(content, "\\\r\n", " ")
+
+	// Strip the "target:" prefix
+	if idx := strings.Index(content, ":"); idx >= 0 {
+		content = content[idx+1:]
+	}
+
+	var deps []string
+	for _, d := range strings.Fields(content) {
+		deps = append(deps, d)
+	}
+	return deps
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		if !contains(list, item) {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func contains(list []string, item string) bool {
+	for _, existing := range list {
+		if existing == item {
+			return true
+		}
+	}
+	return false
+}
+
+func expandVars(s string) string {
+	return expandTargetVars(s, defaultTarget())
+}
+
+// expandTargetVars expands variables with {output} and {exe} referring to the
+// given target. An empty target falls back to the project's build dir and name.
+func expandTargetVars(s, target string) string {
+	output, exe := buildDir, exeName(cfg.Project.Name)
+	if target != "" {
+		output, exe = outputDir(target), exeName(target)
+	}
+	cwd, _ := os.Getwd()
+	s = strings.ReplaceAll(s, "{projectRoot}", filepath.ToSlash(cwd))
+	s = strings.ReplaceAll(s, "{output}", output)
+	s = strings.ReplaceAll(s, "{exe}", exe)
+	for _, name := range []string{"cc", "cxx", "ar", "objcopy", "strip"} {
+		if strings.Contains(s, "{"+name+"}") {
+			s = strings.ReplaceAll(s, "{"+name+"}", tool(name))
+		}
+	}
+	for k, v := range cfg.Project.Vars {
+		s = strings.ReplaceAll(s, "{"+k+"}", v)
+	}
+	return s
+}
+
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	totalSeconds := int(d.Seconds())
+	if totalSeconds < 60 {
+		return fmt.Sprintf("%.2fs", d.Seconds())
+	}
+	minutes := totalSeconds / 60
+	seconds := totalSeconds % 60
+	return fmt.Sprintf("%dm %ds", minutes, seconds)
+}
+
+func exeName(name string) string {
+	if plat == "windows" {
+		return name + ".exe"
+	}
+	return name
+}
+
+func run(name string, args ...string) {
+	printCmd(name, strings.Join(args, " "))
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		printError("FAILED:", err)
+		os.Exit(1)
+	}
+}
+
+// --- Code generation rules ---
+
+// ruleRun is one invocation of a rule: every input at once, or a single
+// input when the outputs are named per input with {stem}.
+type ruleRun struct {
+	inputs  []string
+	outputs []string
+}
+
+func findRule(name string) (Rule, bool) {
+	for _, r := range cfg.Rules {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// genDir is where a target's rules write their outputs.
+func genDir(target string) string {
+	return filepath.Join(cacheDir, target, "_gen")
+}
+
+// ruleRuns expands a rule's inputs and outputs for a target.
+func ruleRuns(target string, r Rule) []ruleRun {
+	var inputs []string
+	for _, pat := range r.Inputs {
+		matches, _ := filepath.Glob(expandTargetVars(pat, target))
+		inputs = append(inputs, matches...)
+	}
+	outputs := func(stem string) []string {
+		var outs []string
+		for _, o := range r.Outputs {
+			o = strings.ReplaceAll(expandTargetVars(o, target), "{stem}", stem)
+			outs = append(outs, filepath.Join(genDir(target), o))
+		}
+		return outs
+	}
+
+	perInput := false
+	for _, o := range r.Outputs {
+		perInput = perInput || strings.Contains(o, "{stem}")
+	}
+	if !perInput {
+		return []ruleRun{{inputs: inputs, outputs: outputs("")}}
+	}
+	var runs []ruleRun
+	for _, in := range inputs {
+		stem := strings.TrimSuffix(filepath.Base(in), filepath.Ext(in))
+		runs = append(runs, ruleRun{inputs: []string{in}, outputs: outputs(stem)})
+	}
+	return runs
+}
+
+// ruleOutputs lists every file the target's rules generate.
+func ruleOutputs(target string, t Target) []string {
+	var outs []string
+	for _, name := range t.Rules {
+		r, _ := findRule(name)
+		for _, run := range ruleRuns(target, r) {
+			outs = append(outs, run.outputs...)
+		}
+	}
+	return outs
+}
+
+// runRules brings a target's generated files up to date. A run is skipped
+// when every output is newer than its inputs and the command is unchanged,
+// which is recorded in a .sig file beside the first output.
+func runRules(target string, t Target) {
+	for _, name := range t.Rules {
+		r, _ := findRule(name)
+		for _, rr := range ruleRuns(target, r) {
+			if len(rr.outputs) == 0 {
+				continue
+			}
+			var argv []string
+			for _, tok := range strings.Fields(r.Command) {
+				switch tok {
+				case "{in}":
+					argv = append(argv, rr.inputs...)
+				case "{out}":
+					argv = append(argv, rr.outputs...)
+				default:
+					tok = ruleToken(name, tok, "{in}", rr.inputs)
+					tok = ruleToken(name, tok, "{out}", rr.outputs)
+					argv = append(argv, expandTargetVars(tok, target))
+				}
+			}
+			if len(argv) == 0 {
+				printError("error:", "rule '"+name+"' has no command")
+				os.Exit(1)
+			}
+
+			sigFile := rr.outputs[0] + ".sig"
+			sig := strings.Join(argv, "\x00") + "\n"
+			reason := ""
+			if old, err := os.ReadFile(sigFile); err != nil || string(old) != sig {
+				reason = "command changed"
+			}
+			for _, out := range rr.outputs {
+				for _, in := range rr.inputs {
+					if reason == "" && isNewer(in, out) {
+						reason = in + " changed"
+					}
+				}
+				if _, err := os.Stat(out); err != nil {
+					reason = "no output"
+				}
+			}
+			if reason == "" {
+				printSkip(rr.outputs[0])
+				continue
+			}
+			if explain {
+				printExplain(rr.outputs[0], reason)
+			}
+
+			for _, out := range rr.outputs {
+				os.MkdirAll(filepath.Dir(out), 0o755)
+			}
+			run(argv[0], argv[1:]...)
+			os.WriteFile(sigFile, []byte(sig), 0o644)
+		}
+	}
+}
+
+// ruleToken replaces a placeholder inside a larger token, such as
+// --cpp_out={out}, which only makes sense for a single path.
+func ruleToken(rule, tok, placeholder string, paths []string) string {
+	if !strings.Contains(tok, placeholder) {
+		return tok
+	}
+	if len(paths) != 1 {
+		printError("error:", fmt.Sprintf("rule '%s' uses %s inside '%s' but the run has %d paths for it; pass %s as a separate argument", rule, placeholder, tok, len(paths), placeholder))
+		os.Exit(1)
+	}
+	return strings.ReplaceAll(tok, placeholder, paths[0])
+}
+
+// --- Embedded assets ---
+
+// embedBase is the file name, without extension, of a target's generated
+// embed source and header, and the prefix of their symbols.
+func embedBase(target string) string {
+	return cIdentifier(target) + "_embed"
+}
+
+// cIdentifier turns a path or name into a valid C identifier.
+func cIdentifier(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r >= '0' && r <= '9' && i > 0:
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// generateEmbed writes <target>_embed.c and .h into the target's generated
+// dir: one const array per embedded file plus a lookup table by path. The
+// source is only regenerated when the file list changes or a file is newer
+// than it, and the header only rewritten when its content changes.
+func generateEmbed(target string, t Target) {
+	if len(t.Embed) == 0 {
+		return
+	}
+	var files []string
+	for _, pat := range t.Embed {
+		matches, _ := filepath.Glob(expandTargetVars(pat, target))
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && !info.IsDir() {
+				files = appendUnique(files, filepath.ToSlash(m))
+			}
+		}
+	}
+	sort.Strings(files)
+
+	// Paths that differ only in punctuation would declare the same symbol
+	owners := map[string]string{}
+	for _, f := range files {
+		id := cIdentifier(f)
+		if other, ok := owners[id]; ok {
+			printError("error:", "target '"+target+"' embeds "+other+" and "+f+", which both map to the symbol "+embedBase(target)+"_"+id+"; rename one of them")
+			os.Exit(1)
+		}
+		owners[id] = f
+	}
+
+	dir := genDir(target)
+	os.MkdirAll(dir, 0o755)
+	base := embedBase(target)
+	src := filepath.Join(dir, base+".c")
+	sigFile := filepath.Join(dir, base+".c.sig")
+	sig := strings.Join(files, "\n") + "\n"
+
+	// Declarations don't depend on file contents, so includers only rebuild
+	// when the file list changes
+	var h strings.Builder
+	guard := strings.ToUpper(base) + "_H"
+	fmt.Fprintf(&h, "// Generated by larva from the embed setting of target '%s'.\n", target)
+	fmt.Fprintf(&h, "#ifndef %s\n#define %s\n\n#include <stddef.h>\n\n", guard, guard)
+	h.WriteString("#ifdef __cplusplus\nextern \"C\" {\n#endif\n\n")
+	fmt.Fprintf(&h, "typedef struct {\n    const char *name;\n    const unsigned char *data;\n    size_t size;\n} %s_file;\n\n", base)
+	for _, f := range files {
+		id := base + "_" + cIdentifier(f)
+		fmt.Fprintf(&h, "extern const unsigned char %s[];\nextern const size_t %s_size;\n", id, id)
+	}
+	fmt.Fprintf(&h, "\nextern const %s_file %s_files[];\nextern const size_t %s_count;\n\n", base, base, base)
+	fmt.Fprintf(&h, "// %s_find returns the embedded file with the given path, or NULL.\n", base)
+	fmt.Fprintf(&h, "const %s_file *%s_find(const char *name);\n\n", base, base)
+	h.WriteString("#ifdef __cplusplus\n}\n#endif\n\n#endif\n")
+	header := filepath.Join(dir, base+".h")
+	if old, err := os.ReadFile(header); err != nil || string(old) != h.String() {
+		os.WriteFile(header, []byte(h.String()), 0o644)
+	}
+
+	stale := false
+	if old, err := os.ReadFile(sigFile); err != nil || string(old) != sig {
+		stale = true
+	}
+	for _, f := range files {
+		stale = stale || isNewer(f, src)
+	}
+	if !stale {
+		return
+	}
+
+	sizes := map[string]int{}
+	var c bytes.Buffer
+	fmt.Fprintf(&c, "// Generated by larva from the embed setting of target '%s'.\n", target)
+	fmt.Fprintf(&c, "#include <string.h>\n#include \"%s.h\"\n\n", base)
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			printError("error:", err)
+			os.Exit(1)
+		}
+		sizes[f] = len(data)
+
+		// A trailing NUL, not counted in the size, lets text be used as a C string
+		id := base + "_" + cIdentifier(f)
+		fmt.Fprintf(&c, "const unsigned char %s[] = {", id)
+		for i, b := range append(data, 0) {
+			if i%16 == 0 {
+				c.WriteString("\n   ")
+			}
+			fmt.Fprintf(&c, " 0x%02x,", b)
+		}
+		fmt.Fprintf(&c, "\n};\nconst size_t %s_size = %d;\n\n", id, len(data))
+	}
+	fmt.Fprintf(&c, "const %s_file %s_files[] = {\n", base, base)
+	for _, f := range files {
+		id := base + "_" + cIdentifier(f)
+		name := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(f)
+		fmt.Fprintf(&c, "    {\"%s\", %s, %d},\n", name, id, sizes[f])
+	}
+	if len(files) == 0 {
+		c.WriteString("    {NULL, NULL, 0},\n")
+	}
+	fmt.Fprintf(&c, "};\nconst size_t %s_count = %d;\n\n", base, len(files))
+	fmt.Fprintf(&c, "const %s_file *%s_find(const char *name) {\n", base, base)
+	fmt.Fprintf(&c, "    for (size_t i = 0; i < %s_count; i++) {\n", base)
+	fmt.Fprintf(&c, "        if (strcmp(%s_files[i].name, name) == 0) {\n", base)
+	fmt.Fprintf(&c, "            return &%s_files[i];\n        }\n    }\n    return NULL;\n}\n", base)
+
+	os.WriteFile(src, c.Bytes(), 0o644)
+	os.WriteFile(sigFile, []byte(sig), 0o644)
+	printEmbedded(len(files), src)
+}
+
+// --- Sanitizers ---
+
+// sanitizerNames maps each supported -fsanitize value to the short name used
+// in variant directories.
+var sanitizerNames = map[string]string{
+	"address":   "asan",
+	"undefined": "ubsan",
+	"thread":    "tsan",
+	"memory":    "msan",
+	"leak":      "lsan",
+}
+
+// sanitizerConflicts lists pairs of sanitizers whose runtimes can't be
+// linked into the same binary.
+var sanitizerConflicts = [][2]string{
+	{"address", "thread"},
+	{"address", "memory"},
+	{"thread", "memory"},
+	{"leak", "thread"},
+	{"leak", "memory"},
+}
+
+// parseSanitizers splits a --sanitize list into sorted, deduplicated names
+// so the same set always maps to the same variant directory.
+func parseSanitizers(list string) []string {
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = appendUnique(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// checkSanitizers rejects unknown sanitizers and combinations that can't
+// work together.
+func checkSanitizers(list []string) error {
+	for _, s := range list {
+		if _, ok := sanitizerNames[s]; !ok {
+			return fmt.Errorf("unknown sanitizer '%s' (have address, undefined, thread, memory, leak)", s)
+		}
+	}
+	for _, pair := range sanitizerConflicts {
+		if contains(list, pair[0]) && contains(list, pair[1]) {
+			return fmt.Errorf("sanitizers '%s' and '%s' can't be combined", pair[0], pair[1])
+		}
+	}
+	if contains(list, "memory") && compilerFamily() != "clang" {
+		return fmt.Errorf("the memory sanitizer requires compiler = \"clang\"")
+	}
+	return nil
+}
+
+// sanitizeFlags returns the flags added to every compile and link when
+// sanitizers are enabled. Frame pointers keep the reported stacks readable.
+func sanitizeFlags() []string {
+	if len(sanitizers) == 0 {
+		return nil
+	}
+	flags := []string{"-fsanitize=" + strings.Join(sanitizers, ","), "-fno-omit-frame-pointer"}
+	if contains(sanitizers, "memory") {
+		flags = append(flags, "-fsanitize-memory-track-origins")
+	}
+	return flags
+}
+
+// sanitizerEnv returns the environment for running a sanitized executable:
+// sensible runtime options for each enabled sanitizer, unless the user has
+// already set them.
+func sanitizerEnv() []string {
+	env := os.Environ()
+	set := func(name, value string) {
+		if _, ok := os.LookupEnv(name); !ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	if contains(sanitizers, "address") {
+		set("ASAN_OPTIONS", "detect_leaks=1:check_initialization_order=1:detect_stack_use_after_return=1")
+	}
+	if contains(sanitizers, "undefined") {
+		set("UBSAN_OPTIONS", "print_stacktrace=1:halt_on_error=1")
+	}
+	if contains(sanitizers, "thread") {
+		set("TSAN_OPTIONS", "second_deadlock_stack=1")
+	}
+	if contains(sanitizers, "memory") {
+		set("MSAN_OPTIONS", "poison_in_dtor=1")
+	}
+	return env
+}
+
+// --- pkg-config ---
+
+// pkgConfigResult holds what pkg-config reported for one package spec.
+type pkgConfigResult struct {
+	cflags []string
+	libs   []string
+}
+
+var (
+	pkgConfigMu    sync.Mutex
+	pkgConfigCache = map[string]pkgConfigResult{}
+)
+
+// targetPackages resolves the pkg_config packages of a target, including
+// those declared for the platform.
+func targetPackages(name string, t Target, platform string) []pkgConfigResult {
+	specs := append(append([]string{}, t.PkgConfig...), t.Platform[platform].PkgConfig...)
+	var pkgs []pkgConfigResult
+	for _, spec := range specs {
+		pkgs = append(pkgs, pkgConfig(name, spec))
+	}
+	return pkgs
+}
+
+// pkgConfig queries pkg-config for a spec such as "freetype2 >= 2.10". Each
+// spec is only queried once per build. A missing package, or one older than
+// the declared version, is a fatal error.
+func pkgConfig(target, spec string) pkgConfigResult {
+	pkgConfigMu.Lock()
+	defer pkgConfigMu.Unlock()
+	if r, ok := pkgConfigCache[spec]; ok {
+		return r
+	}
+
+	bin := os.Getenv("PKG_CONFIG")
+	if bin == "" {
+		bin = tc.Prefix + "pkg-config"
+	}
+	if err := exec.Command(bin, "--exists", spec).Run(); err != nil {
+		fields := strings.Fields(spec)
+		msg := "package '" + fields[0] + "'"
+		if len(fields) > 1 {
+			msg += " (" + strings.Join(fields[1:], " ") + ")"
+		}
+		msg += " required by target '" + target + "' not found"
+		if have, err := exec.Command(bin, "--modversion", fields[0]).Output(); err == nil {
+			msg += ", have " + strings.TrimSpace(string(have))
+		} else if _, err := exec.LookPath(bin); err != nil {
+			msg += ": " + bin + " is not installed"
+		}
+		printError("error:", msg)
+		os.Exit(1)
+	}
+
+	var r pkgConfigResult
+	cflags, _ := exec.Command(bin, "--cflags", spec).Output()
+	libs, _ := exec.Command(bin, "--libs", spec).Output()
+	r.cflags = strings.Fields(string(cflags))
+	r.libs = strings.Fields(string(libs))
+	pkgConfigCache[spec] = r
+	return r
+}
+
+// --- Tests ---
+
+// testResult is the outcome of one test run.
+type testResult struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"` // "pass", "fail", "crash" or "timeout"
+	Duration time.Duration `json:"-"`
+	Millis   int64         `json:"duration_ms"`
+	ExitCode int           `json:"exit_code"`
+	Message  string        `json:"message,omitempty"`
+	Output   string        `json:"output"`
+}
+
+// testCase is one runnable test.
+type testCase struct {
+	name string
+	run  func() testResult
+}
+
+// doTest builds the test targets and [[golden]] tests matching the given
+// name patterns (all of them without patterns), runs them in parallel and
+// reports the results. It exits non-zero if any test doesn't pass.
+func doTest(patterns []string) {
+	var names, build []string
+	for _, name := range sortedTargets() {
+		if cfg.Targets[name].Kind == "test" && matchesAny(name, patterns) {
+			names = append(names, name)
+			build = append(build, name)
+		}
+	}
+	var goldens []Golden
+	for i, g := range cfg.Golden {
+		if g.Name == "" {
+			g.Name = g.Target + ":" + strings.TrimSuffix(filepath.Base(g.Expected), filepath.Ext(g.Expected))
+		}
+		if t, ok := cfg.Targets[g.Target]; !ok || (t.Kind != "executable" && t.Kind != "test") {
+			printError("error:", fmt.Sprintf("golden test %d: '%s' is not an executable target", i+1, g.Target))
+			os.Exit(1)
+		}
+		if g.Expected == "" {
+			printError("error:", "golden test '"+g.Name+"' has no expected file")
+			os.Exit(1)
+		}
+		if matchesAny(g.Name, patterns) {
+			goldens = append(goldens, g)
+			build = appendUnique(build, g.Target)
+		}
+	}
+	if len(build) == 0 {
+		printError("error:", "no tests match")
+		os.Exit(1)
+	}
+	doBuild(build)
+
+	var cases []testCase
+	for _, name := range names {
+		name := name
+		cases = append(cases, testCase{name: name, run: func() testResult { return runTestTarget(name) }})
+	}
+	for _, g := range goldens {
+		g := g
+		cases = append(cases, testCase{name: g.Name, run: func() testResult { return runGolden(g) }})
+	}
+	reportTests(runTests(cases))
+}
+
+// runGolden runs a golden test from the project root and compares its
+// stdout with the expected file, or rewrites the file with --update. Line
+// endings are normalized so Windows output compares equal.
+func runGolden(g Golden) testResult {
+	timeout := 60 * time.Second
+	if g.Timeout != "" {
+		d, err := time.ParseDuration(g.Timeout)
+		if err != nil {
+			printError("error:", "golden test '"+g.Name+"': invalid timeout '"+g.Timeout+"'")
+			os.Exit(1)
+		}
+		timeout = d
+	}
+	exe, _ := filepath.Abs(filepath.Join(outputDir(g.Target), exeName(g.Target)))
+	var args []string
+	for _, a := range g.Args {
+		args = append(args, expandTargetVars(a, g.Target))
+	}
+
+	cmd := runnerCommand(exe, args...)
+	cmd.Env = sanitizerEnv()
+	if g.Stdin != "" {
+		in, err := os.Open(g.Stdin)
+		if err != nil {
+			return testResult{Name: g.Name, Status: "fail", ExitCode: -1, Message: err.Error()}
+		}
+		defer in.Close()
+		cmd.Stdin = in
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	r := runTestCommand(g.Name, cmd, timeout, &stderr)
+
+	// A non-zero exit is only a failure when it isn't the expected one
+	if r.Status == "fail" && r.ExitCode == g.ExitCode {
+		r.Status, r.Message = "pass", ""
+	} else if r.Status == "pass" && g.ExitCode != 0 {
+		r.Status, r.Message = "fail", fmt.Sprintf("exit status 0, want %d", g.ExitCode)
+	}
+	if r.Status != "pass" {
+		return r
+	}
+
+	actual := strings.ReplaceAll(stdout.String(), "\r\n", "\n")
+	if update {
+		writeReport(g.Expected, []byte(actual))
+		r.Message = "updated " + g.Expected
+		return r
+	}
+	expected, err := os.ReadFile(g.Expected)
+	if err != nil {
+		r.Status, r.Message = "fail", "missing "+g.Expected+" (run larva test --update)"
+		return r
+	}
+	if want := strings.ReplaceAll(string(expected), "\r\n", "\n"); actual != want {
+		r.Status, r.Message = "fail", "stdout differs from "+g.Expected
+		r.Output = unifiedDiff(g.Expected, "stdout", want, actual) + r.Output
+	}
+	return r
+}
+
+// unifiedDiff renders the line differences between a and b as a unified
+// diff with three lines of context.
+func unifiedDiff(aName, bName, a, b string) string {
+	al := strings.SplitAfter(a, "\n")
+	bl := strings.SplitAfter(b, "\n")
+	if al[len(al)-1] == "" {
+		al = al[:len(al)-1]
+	}
+	if bl[len(bl)-1] == "" {
+		bl = bl[:len(bl)-1]
+	}
+
+	// Edit script from the longest common subsequence, with the common
+	// prefix and suffix trimmed first to keep the table small
+	type edit struct {
+		op   byte // ' ', '-' or '+'
+		line string
+	}
+	pre := 0
+	for pre < len(al) && pre < len(bl) && al[pre] == bl[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(al)-pre && suf < len(bl)-pre && al[len(al)-1-suf] == bl[len(bl)-1-suf] {
+		suf++
+	}
+	am, bm := al[pre:len(al)-suf], bl[pre:len(bl)-suf]
+	// Past a few million cells, show the middle as replaced wholesale
+	tooBig := len(am)*len(bm) > 4_000_000
+	var lcs [][]int
+	if !tooBig {
+		lcs = make([][]int, len(am)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(bm)+1)
+		}
+	}
+	for i := len(am) - 1; i >= 0 && !tooBig; i-- {
+		for j := len(bm) - 1; j >= 0; j-- {
+			if am[i] == bm[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var edits []edit
+	for _, l := range al[:pre] {
+		edits = append(edits, edit{' ', l})
+	}
+	i, j := 0, 0
+	for i < len(am) || j < len(bm) {
+		switch {
+		case i < len(am) && j < len(bm) && am[i] == bm[j]:
+			edits = append(edits, edit{' ', am[i]})
+			i++
+			j++
+		case i < len(am) && (j == len(bm) || tooBig || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', am[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', bm[j]})
+			j++
+		}
+	}
+	for _, l := range al[len(al)-suf:] {
+		edits = append(edits, edit{' ', l})
+	}
+
+	// Group changes into hunks, merging those within 2*context lines
+	const context = 3
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+		start := max(k-context, 0)
+		end := k
+		for end < len(edits) {
+			if edits[end].op != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(edits) && edits[run].op == ' ' {
+				run++
+			}
+			if run == len(edits) || run-end > 2*context {
+				end = min(end+context, len(edits))
+				break
+			}
+			end = run
+		}
+
+		// Line numbers of the hunk start in a and b
+		aStart, bStart := 1, 1
+		for _, e := range edits[:start] {
+			if e.op != '+' {
+				aStart++
+			}
+			if e.op != '-' {
+				bStart++
+			}
+		}
+		aLen, bLen := 0, 0
+		var body strings.Builder
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				aLen++
+			}
+			if e.op != '-' {
+				bLen++
+			}
+			body.WriteByte(e.op)
+			body.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				body.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		// An empty range names the line before it
+		if aLen == 0 {
+			aStart--
+		}
+		if bLen == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n%s", aStart, aLen, bStart, bLen, body.String())
+		k = end
+	}
+	return out.String()
+}
+
+// matchesAny reports whether name matches one of the glob patterns, or
+// whether there are no patterns at all.
+func matchesAny(name string, patterns []string) bool {
+	for _, pat := range patterns {
+		if ok, _ := filepath.Match(pat, name); ok {
+			return true
+		}
+	}
+	return len(patterns) == 0
+}
+
+// runTests runs test cases on a pool of -j workers and returns their
+// results in the order of cases. Each result is printed as it completes.
+func runTests(cases []testCase) []testResult {
+	results := make([]testResult, len(cases))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan int)
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				r := cases[i].run()
+				r.Millis = r.Duration.Milliseconds()
+				results[i] = r
+				mu.Lock()
+				printTestResult(r)
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range cases {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
+
+// runTestTarget runs a built test executable with its timeout, capturing
+// its output.
+func runTestTarget(name string) testResult {
+	timeout := 60 * time.Second
+	if t := cfg.Targets[name].Timeout; t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			printError("error:", "target '"+name+"': invalid timeout '"+t+"'")
+			os.Exit(1)
+		}
+		timeout = d
+	}
+	exe, _ := filepath.Abs(filepath.Join(outputDir(name), exeName(name)))
+	dir, _ := filepath.Abs(outputDir(name))
+
+	cmd := runnerCommand(exe)
+	cmd.Dir = dir
+	cmd.Env = sanitizerEnv()
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	return runTestCommand(name, cmd, timeout, &out)
+}
+
+// runTestCommand runs cmd, killing it after timeout, and classifies the
+// outcome: a non-zero exit fails, a signal is a crash.
+func runTestCommand(name string, cmd *exec.Cmd, timeout time.Duration, out *bytes.Buffer) testResult {
+	r := testResult{Name: name, Status: "pass"}
+	// Don't wait forever on children of a killed test holding its output open
+	cmd.WaitDelay = time.Second
+	start := time.Now()
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err = <-done:
+		case <-time.After(timeout):
+			cmd.Process.Kill()
+			<-done
+			r.Status = "timeout"
+			r.Message = "timed out after " + timeout.String()
+		}
+	}
+	r.Duration = time.Since(start)
+	r.Output = out.String()
+	if r.Status == "timeout" {
+		r.ExitCode = -1
+		return r
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == -1:
+		r.Status, r.ExitCode, r.Message = "crash", -1, err.Error()
+	case errors.As(err, &exitErr):
+		r.Status, r.ExitCode, r.Message = "fail", exitErr.ExitCode(), err.Error()
+	default:
+		r.Status, r.ExitCode, r.Message = "crash", -1, err.Error()
+	}
+	return r
+}
+
+// reportTests prints the summary, writes the requested reports and exits
+// non-zero if any test didn't pass.
+func reportTests(results []testResult) {
+	failed := 0
+	for _, r := range results {
+		if r.Status != "pass" {
+			failed++
+		}
+	}
+	if junitPath != "" {
+		writeReport(junitPath, junitReport(results))
+	}
+	if jsonPath != "" {
+		data, _ := json.MarshalIndent(results, "", "  ")
+		writeReport(jsonPath, append(data, '\n'))
+	}
+
+	summary := fmt.Sprintf("%d passed, %d failed.", len(results)-failed, failed)
+	if failed > 0 {
+		printError("FAILED:", summary)
+		os.Exit(1)
+	}
+	printSuccess(summary)
+}
+
+func writeReport(path string, data []byte) {
+	if dir := filepath.Dir(path); dir != "." {
+		os.MkdirAll(dir, 0o755)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		printError("error:", err)
+		os.Exit(1)
+	}
+}
+
+// JUnit XML schema, as read by CI systems such as Jenkins and GitLab
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
 
-func printSkip(file string) {
-	fmt.Printf("  %s %s\n", dim("skip"), dim(file))
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
 }
 
-func printCopied(count int, pattern string) {
-	fmt.Printf("  %s %d file(s) matching %s\n", teal("copied"), count, pattern)
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",chardata"`
 }
 
-func printRunning(exe string) {
-	fmt.Printf("  %s %s\n", teal("running"), exe)
+// junitReport renders results as a JUnit XML test suite. Failed runs are
+// failures; crashes and timeouts are errors.
+func junitReport(results []testResult) []byte {
+	suite := junitSuite{Name: cfg.Project.Name, Tests: len(results)}
+	for _, r := range results {
+		c := junitCase{Name: r.Name, ClassName: cfg.Project.Name, Time: r.Duration.Seconds(), SystemOut: r.Output}
+		problem := &junitProblem{Message: r.Message, Type: r.Status, Body: r.Output}
+		switch r.Status {
+		case "fail":
+			c.Failure = problem
+			suite.Failures++
+		case "crash", "timeout":
+			c.Error = problem
+			suite.Errors++
+		}
+		suite.Time += c.Time
+		suite.Cases = append(suite.Cases, c)
+	}
+	data, _ := xml.MarshalIndent(suite, "", "  ")
+	return append([]byte(xml.Header), append(data, '\n')...)
 }
 
-func printRemoved(dir string) {
-	fmt.Printf("  %s %s\n", teal("removed"), dir)
+// --- Object cache ---
+
+// objectCache is a content-addressed store of compiled objects shared by
+// every checkout on the machine. Entries are keyed by the preprocessed
+// source, the command line and the compiler identity, and live in
+// <dir>/<key[:2]>/<key>/ as an object plus its .d file. A nil cache is
+// disabled: every method is a no-op.
+type objectCache struct {
+	dir      string
+	maxSize  int64
+	hardlink bool
+	remote   *remoteCache
+
+	mu         sync.Mutex
+	hits       int
+	remoteHits int
+	misses     int
 }
 
-func printSuccess(msg string) {
-	fmt.Println(bright(msg))
+// objCache is nil unless [cache] is enabled.
+var objCache *objectCache
+
+const defaultCacheSize = 5 << 30
+
+func newObjectCache(c Cache) *objectCache {
+	maxSize := int64(defaultCacheSize)
+	if c.MaxSize != "" {
+		n, err := parseSize(c.MaxSize)
+		if err != nil {
+			printError("error:", "cache.max_size: "+err.Error())
+			os.Exit(1)
+		}
+		maxSize = n
+	}
+	cache := &objectCache{dir: cacheRoot(c), maxSize: maxSize, hardlink: c.Hardlink}
+	if c.Remote.URL != "" {
+		cache.remote = newRemoteCache(c.Remote)
+	}
+	return cache
 }
 
-func printError(msg string, detail interface{}) {
-	fmt.Fprintf(os.Stderr, "%s %v\n", errclr(msg), detail)
+// cacheRoot resolves the configured cache directory, expanding a leading ~.
+func cacheRoot(c Cache) string {
+	dir := c.Dir
+	if dir == "" {
+		dir = "~/.cache/larva"
+	}
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, dir[1:])
+	}
+	return dir
 }
 
-func printCmd(name string, args string) {
-	fmt.Printf("  %s %s\n", teal(name), dim(args))
+// key hashes everything that determines the object a job produces. It
+// returns "" if the source can't be preprocessed; the job then compiles
+// normally and reports the error.
+func (c *objectCache) key(job compileJob) string {
+	if c == nil {
+		return ""
+	}
+
+	// Preprocess instead of compiling, dropping the dependency and output
+	// arguments, which also stay out of the hash
+	var ppArgs, keyArgs []string
+	for i := 0; i < len(job.args); i++ {
+		a := job.args[i]
+		switch {
+		case a == "-MMD":
+			continue
+		case a == "-MF" || a == "-o":
+			i++
+			continue
+		case a == "-c":
+			ppArgs = append(ppArgs, "-E")
+			keyArgs = append(keyArgs, a)
+			continue
+		}
+		ppArgs = append(ppArgs, a)
+		if a != job.src {
+			keyArgs = append(keyArgs, a)
+		}
+	}
+	pp, err := exec.Command(job.compiler, ppArgs...).Output()
+	if err != nil {
+		return ""
+	}
+
+	h := sha256.New()
+	id := compilerIdentity(job.compiler)
+	fmt.Fprintf(h, "larva-object-v1\x00%x\x00%s\x00", id, job.compiler)
+	if toolchain != "" {
+		fmt.Fprintf(h, "toolchain\x00%s\x00", toolchain)
+	}
+	for _, a := range keyArgs {
+		h.Write([]byte(a + "\x00"))
+		// Debug info embeds the working directory, so it has to match too
+		if strings.HasPrefix(a, "-g") {
+			cwd, _ := os.Getwd()
+			h.Write([]byte(cwd + "\x00"))
+		}
+	}
+	h.Write(pp)
+	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-// --- Helpers ---
+func (c *objectCache) entryDir(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
 
-func resolveCompiler(lang string) (compiler, stdFlag string) {
-	isCpp := strings.HasPrefix(lang, "c++")
-	switch cfg.Project.Compiler {
-	case "clang":
-		if isCpp {
-			return "clang++", "-std=" + lang
+// fetch copies (or hardlinks) a cached object and its .d file into place.
+func (c *objectCache) fetch(key string, job compileJob) bool {
+	if c == nil || key == "" {
+		return false
+	}
+	entry := c.entryDir(key)
+	ok := c.place(filepath.Join(entry, "obj"), job.obj) == nil &&
+		copyFile(filepath.Join(entry, "d"), job.dep) == nil
+
+	// Fall back to the remote cache, keeping a local copy of what it returns
+	remoteHit := false
+	if !ok {
+		if obj, dep, found := c.remote.get(key); found {
+			c.storeBytes(key, obj, dep)
+			ok = c.place(filepath.Join(entry, "obj"), job.obj) == nil &&
+				copyFile(filepath.Join(entry, "d"), job.dep) == nil
+			remoteHit = ok
 		}
-		return "clang", "-std=" + lang
+	}
+
+	c.mu.Lock()
+	switch {
+	case remoteHit:
+		c.remoteHits++
+	case ok:
+		c.hits++
 	default:
-		if isCpp {
-			return "g++", "-std=" + lang
-		}
-		return "gcc", "-std=" + lang
+		c.misses++
+	}
+	c.mu.Unlock()
+
+	if ok {
+		// Entry mtimes drive LRU eviction
+		now := time.Now()
+		os.Chtimes(entry, now, now)
 	}
+	return ok
 }
 
-func sourceExt(lang string) string {
-	if strings.HasPrefix(lang, "c++") {
-		return ".cpp"
+func (c *objectCache) place(src, dst string) error {
+	if c.hardlink {
+		os.Remove(dst)
+		if err := os.Link(src, dst); err == nil {
+			// The object must look newer than its sources
+			now := time.Now()
+			return os.Chtimes(dst, now, now)
+		}
 	}
-	return ".c"
+	return copyFile(src, dst)
 }
 
-func isNewer(src, dst string) bool {
-	srcInfo, err := os.Stat(src)
+// store adds a freshly compiled object to the cache. It writes into a
+// temporary directory first so concurrent builds never see partial entries.
+// Uploads to the remote cache, if any, happen here too.
+func (c *objectCache) store(key string, job compileJob) {
+	if c == nil {
+		return
+	}
+	obj, err := os.ReadFile(job.obj)
 	if err != nil {
-		return true
+		return
 	}
-	dstInfo, err := os.Stat(dst)
+	dep, err := os.ReadFile(job.dep)
 	if err != nil {
-		return true
+		return
 	}
-	return srcInfo.ModTime().After(dstInfo.ModTime())
+	c.storeBytes(key, obj, dep)
+	c.remote.put(key, obj, dep)
 }
 
-func needsRecompile(src, obj, dep string) bool {
-	objInfo, err := os.Stat(obj)
+func (c *objectCache) storeBytes(key string, obj, dep []byte) {
+	entry := c.entryDir(key)
+	if _, err := os.Stat(entry); err == nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(entry), 0o755)
+	tmp, err := os.MkdirTemp(filepath.Dir(entry), "tmp-")
 	if err != nil {
-		return true
+		return
 	}
-	objTime := objInfo.ModTime()
+	if os.WriteFile(filepath.Join(tmp, "obj"), obj, 0o644) != nil || os.WriteFile(filepath.Join(tmp, "d"), dep, 0o644) != nil {
+		os.RemoveAll(tmp)
+		return
+	}
+	if os.Rename(tmp, entry) != nil {
+		os.RemoveAll(tmp)
+	}
+}
 
-	// Check source file
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return true
+// finish records this build's hit/miss counts and evicts old entries.
+func (c *objectCache) finish() {
+	if c == nil {
+		return
 	}
-	if srcInfo.ModTime().After(objTime) {
-		return true
+	stats := readCacheStats(c.dir)
+	stats.Hits += c.hits
+	stats.RemoteHits += c.remoteHits
+	stats.Misses += c.misses
+	writeCacheStats(c.dir, stats)
+	c.hits, c.remoteHits, c.misses = 0, 0, 0
+	c.evict()
+}
+
+// evict removes least recently used entries until the cache fits maxSize.
+func (c *objectCache) evict() {
+	entries, total := cacheEntries(c.dir)
+	if total <= c.maxSize {
+		return
 	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	for _, e := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		os.RemoveAll(e.path)
+		total -= e.size
+	}
+}
 
-	// Check header dependencies from .d file
-	for _, h := range parseDeps(dep) {
-		if hInfo, err := os.Stat(h); err == nil && hInfo.ModTime().After(objTime) {
-			return true
+type cacheEntry struct {
+	path string
+	size int64
+	used time.Time
+}
+
+func cacheEntries(dir string) ([]cacheEntry, int64) {
+	var entries []cacheEntry
+	var total int64
+	shards, _ := os.ReadDir(dir)
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+		keys, _ := os.ReadDir(filepath.Join(dir, shard.Name()))
+		for _, k := range keys {
+			if !k.IsDir() || strings.HasPrefix(k.Name(), "tmp-") {
+				continue
+			}
+			path := filepath.Join(dir, shard.Name(), k.Name())
+			info, err := k.Info()
+			if err != nil {
+				continue
+			}
+			e := cacheEntry{path: path, used: info.ModTime()}
+			files, _ := os.ReadDir(path)
+			for _, f := range files {
+				if fi, err := f.Info(); err == nil {
+					e.size += fi.Size()
+				}
+			}
+			entries = append(entries, e)
+			total += e.size
 		}
 	}
+	return entries, total
+}
 
-	return false
+type cacheStats struct {
+	Hits       int `json:"hits"`
+	RemoteHits int `json:"remote_hits"`
+	Misses     int `json:"misses"`
 }
 
-func parseDeps(depFile string) []string {
-	data, err := os.ReadFile(depFile)
-	if err != nil {
-		return nil
+func readCacheStats(dir string) cacheStats {
+	var stats cacheStats
+	if data, err := os.ReadFile(filepath.Join(dir, "stats.json")); err == nil {
+		json.Unmarshal(data, &stats)
 	}
+	return stats
+}
 
-	// .d format: "target: dep1 dep2 dep3 ..."
-	// Continuations use backslash-newline
-	content := strings.ReplaceAll(string(data), "\\\n", " ")
-	content = strings.ReplaceAll(content, "\\\r\n", " ")
+func writeCacheStats(dir string, stats cacheStats) {
+	os.MkdirAll(dir, 0o755)
+	data, _ := json.MarshalIndent(stats, "", "  ")
+	os.WriteFile(filepath.Join(dir, "stats.json"), data, 0o644)
+}
 
-	// Strip the "target:" prefix
-	if idx := strings.Index(content, ":"); idx >= 0 {
-		content = content[idx+1:]
+// remoteCache talks to an HTTP cache using plain GET and PUT on
+// <url>/ac/<key>, the protocol bazel-remote serves. Each entry is a JSON
+// bundle of the object and its .d file. After the first network error or
+// timeout the remote is skipped for the rest of the build, so a slow or
+// unreachable server only ever costs one timeout. A nil remote is disabled.
+type remoteCache struct {
+	url      string
+	readOnly bool
+	headers  map[string]string
+	client   *http.Client
+
+	mu       sync.Mutex
+	disabled bool
+}
+
+type remoteEntry struct {
+	Obj []byte `json:"obj"`
+	Dep []byte `json:"d"`
+}
+
+func newRemoteCache(r RemoteCache) *remoteCache {
+	timeout := 10 * time.Second
+	if r.Timeout != "" {
+		d, err := time.ParseDuration(r.Timeout)
+		if err != nil {
+			printError("error:", "cache.remote.timeout: "+err.Error())
+			os.Exit(1)
+		}
+		timeout = d
 	}
+	headers := map[string]string{}
+	for k, v := range r.Headers {
+		headers[k] = os.ExpandEnv(v)
+	}
+	return &remoteCache{
+		url:      strings.TrimSuffix(r.URL, "/"),
+		readOnly: r.ReadOnly,
+		headers:  headers,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
 
-	var deps []string
-	for _, d := range strings.Fields(content) {
-		deps = append(deps, d)
+func (r *remoteCache) get(key string) (obj, dep []byte, ok bool) {
+	if r.unavailable() {
+		return nil, nil, false
 	}
-	return deps
+	resp, err := r.do(http.MethodGet, key, nil)
+	if err != nil {
+		r.fail(err)
+		return nil, nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, false
+	}
+	if resp.StatusCode != http.StatusOK {
+		r.fail(fmt.Errorf("download rejected: %s", resp.Status))
+		return nil, nil, false
+	}
+	var entry remoteEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		r.fail(err)
+		return nil, nil, false
+	}
+	return entry.Obj, entry.Dep, true
 }
 
-func expandVars(s string) string {
-	cwd, _ := os.Getwd()
-	s = strings.ReplaceAll(s, "{projectRoot}", filepath.ToSlash(cwd))
-	s = strings.ReplaceAll(s, "{output}", buildDir)
-	s = strings.ReplaceAll(s, "{exe}", exeName(cfg.Project.Name))
-	for k, v := range cfg.Project.Vars {
-		s = strings.ReplaceAll(s, "{"+k+"}", v)
+func (r *remoteCache) put(key string, obj, dep []byte) {
+	if r.unavailable() || r.readOnly {
+		return
+	}
+	body, _ := json.Marshal(remoteEntry{Obj: obj, Dep: dep})
+	resp, err := r.do(http.MethodPut, key, body)
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		r.fail(fmt.Errorf("upload rejected: %s", resp.Status))
 	}
-	return s
 }
 
-func formatDuration(d time.Duration) string {
-	if d < time.Second {
-		return fmt.Sprintf("%dms", d.Milliseconds())
+func (r *remoteCache) do(method, key string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, r.url+"/ac/"+key, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
 	}
-	totalSeconds := int(d.Seconds())
-	if totalSeconds < 60 {
-		return fmt.Sprintf("%.2fs", d.Seconds())
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
 	}
-	minutes := totalSeconds / 60
-	seconds := totalSeconds % 60
-	return fmt.Sprintf("%dm %ds", minutes, seconds)
+	return r.client.Do(req)
 }
 
-func exeName(name string) string {
-	if runtime.GOOS == "windows" {
-		return name + ".exe"
+func (r *remoteCache) unavailable() bool {
+	if r == nil {
+		return true
 	}
-	return name
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.disabled
 }
 
-func run(name string, args ...string) {
-	printCmd(name, strings.Join(args, " "))
-	cmd := exec.Command(name, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		printError("FAILED:", err)
+// fail disables the remote for the rest of the build, warning once.
+func (r *remoteCache) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.disabled {
+		r.disabled = true
+		printError("warning:", "remote cache unavailable, compiling locally: "+err.Error())
+	}
+}
+
+// doCache implements `larva cache stats|clear`.
+func doCache(args []string) {
+	dir := cacheRoot(cfg.Cache)
+	sub := "stats"
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	switch sub {
+	case "stats":
+		entries, total := cacheEntries(dir)
+		stats := readCacheStats(dir)
+		maxSize := int64(defaultCacheSize)
+		if n, err := parseSize(cfg.Cache.MaxSize); err == nil {
+			maxSize = n
+		}
+		rate := 0.0
+		if lookups := stats.Hits + stats.RemoteHits + stats.Misses; lookups > 0 {
+			rate = 100 * float64(stats.Hits+stats.RemoteHits) / float64(lookups)
+		}
+		state := "disabled"
+		if cfg.Cache.Enabled {
+			state = "enabled"
+		}
+		fmt.Printf("  %s %s (%s)\n", teal("directory"), dir, state)
+		fmt.Printf("  %s   %d\n", teal("entries"), len(entries))
+		fmt.Printf("  %s      %s / %s\n", teal("size"), formatSize(total), formatSize(maxSize))
+		fmt.Printf("  %s      %d\n", teal("hits"), stats.Hits)
+		if cfg.Cache.Remote.URL != "" {
+			fmt.Printf("  %s    %s\n", teal("remote"), cfg.Cache.Remote.URL)
+			fmt.Printf("  %s %d\n", teal("remote hits"), stats.RemoteHits)
+		}
+		fmt.Printf("  %s    %d\n", teal("misses"), stats.Misses)
+		fmt.Printf("  %s  %.1f%%\n", teal("hit rate"), rate)
+	case "clear":
+		entries, _ := cacheEntries(dir)
+		for _, e := range entries {
+			os.RemoveAll(e.path)
+		}
+		writeCacheStats(dir, cacheStats{})
+		printRemoved(dir)
+		printSuccess("Cache cleared.")
+	default:
+		printError("error:", "unknown cache command '"+sub+"' (expected stats or clear)")
 		os.Exit(1)
 	}
 }
 
+// parseSize parses sizes like "512M", "5G" or a plain byte count.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	s = strings.TrimSuffix(s, "B")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	case strings.HasSuffix(s, "T"):
+		mult = 1 << 40
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0o644)
+}
+
 // --- compile_commands.json Generation ---
 
 type CompileCommand struct {
@@ -587,46 +3411,29 @@ func doGenerateCompileCommands() {
 	cwd, _ := os.Getwd()
 	var commands []CompileCommand
 
-	for _, name := range targetBuildOrder() {
-		t := cfg.Targets[name]
-		compiler, stdFlag := resolveCompiler(t.Language)
-
-		// Resolve sources
-		var sources []string
-		for _, pat := range t.Sources {
-			matches, _ := filepath.Glob(pat)
-			sources = append(sources, matches...)
-		}
-
-		// Resolve includes
-		includes := t.Includes
-		systemIncludes := t.SystemIncludes
-		if p, ok := t.Platform[plat]; ok {
-			includes = append(includes, p.Includes...)
-			systemIncludes = append(systemIncludes, p.SystemIncludes...)
-		}
+	order, err := buildOrder(sortedTargets())
+	if err != nil {
+		printError("error:", err)
+		os.Exit(1)
+	}
 
-		// Resolve flags
-		var flags []string
-		if mode == "release" {
-			flags = t.Release.Flags
-		} else {
-			flags = t.Debug.Flags
-		}
-		for i, f := range flags {
-			flags[i] = expandVars(f)
+	for _, name := range order {
+		t := cfg.Targets[name]
+		flags := targetFlags(name, t, plat)
+		pchLang := ""
+		if t.PCH != "" {
+			pchLang = pchLanguage(t)
 		}
 
-		for _, src := range sources {
-			var args []string
-			args = append(args, compiler, "-c", stdFlag)
-			args = append(args, t.Flags...)
-			args = append(args, flags...)
-			for _, inc := range includes {
-				args = append(args, "-I", inc)
+		for _, src := range targetSources(t) {
+			lang := sourceLanguage(t, src)
+			if lang != "c" && lang != "c++" && lang != "asm" {
+				continue
 			}
-			for _, inc := range systemIncludes {
-				args = append(args, "-isystem", inc)
+			compiler, compileArgs := sourceCommand(t, lang, flags)
+			args := append([]string{compiler}, compileArgs...)
+			if lang == pchLang {
+				args = append(args, "-include", t.PCH)
 			}
 			args = append(args, src)
 
@@ -648,46 +3455,132 @@ func doGenerateCompileCommands() {
 	printSuccess("Generated compile_commands.json")
 }
 
-func targetBuildOrder() []string {
-	var order []string
-	for name, t := range cfg.Targets {
-		if t.Kind == "executable" {
-			for _, dep := range t.Deps {
-				order = append(order, dep)
+// buildOrder resolves the dependency graph below the given targets into a
+// deterministic topological order, dependencies first. It fails on undefined
+// targets and on cycles, naming the cycle's path.
+func buildOrder(roots []string) ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := map[string]int{}
+	var order, stack []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			// Report the cycle starting from the first occurrence of name
+			for i, n := range stack {
+				if n == name {
+					cycle := append(append([]string{}, stack[i:]...), name)
+					return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+				}
 			}
-			order = append(order, name)
-			return order
 		}
-	}
-	// Fallback: just return all targets
-	for name := range cfg.Targets {
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, dep := range cfg.Targets[name].Deps {
+			if _, ok := cfg.Targets[dep]; !ok {
+				return fmt.Errorf("target '%s' depends on undefined target '%s'", name, dep)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
 		order = append(order, name)
+		return nil
 	}
-	return order
+
+	for _, root := range roots {
+		if _, ok := cfg.Targets[root]; !ok {
+			return nil, fmt.Errorf("undefined target '%s'", root)
+		}
+		if err := visit(root); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
 }
 
 // --- VS Solution Generation ---
 
+// vsProject is one generated .vcxproj, referenced from the solution.
+type vsProject struct {
+	name string
+	guid string
+	path string
+}
+
+// vsConfig is one solution configuration, generated per build mode.
+type vsConfig struct {
+	name    string // "Debug", "Release", "Profile", ...
+	mode    string
+	defines string
+	output  string
+}
+
+// vsConfigName capitalizes a mode name for use as a VS configuration.
+func vsConfigName(m string) string {
+	return strings.ToUpper(m[:1]) + m[1:]
+}
+
+// larvaCommand is the build command a VS configuration runs for a target.
+func larvaCommand(target, m string) string {
+	switch m {
+	case "debug":
+		return "larva build " + target
+	case "release":
+		return "larva release " + target
+	}
+	return "larva build " + target + " --mode " + m
+}
+
 func doGenerateVS() {
-	// Find the executable target
-	var mainName string
-	var mainTarget Target
-	for name, t := range cfg.Targets {
-		if t.Kind == "executable" {
-			mainName = name
-			mainTarget = t
-			break
+	// One project per executable target
+	var projects []vsProject
+	for _, name := range sortedTargets() {
+		t := cfg.Targets[name]
+		if t.Kind != "executable" {
+			continue
+		}
+		order, err := buildOrder([]string{name})
+		if err != nil {
+			printError("error:", err)
+			os.Exit(1)
 		}
+		deps := order[:len(order)-1]
+		projects = append(projects, generateVSProject(name, t, deps))
 	}
-	if mainName == "" {
+	if len(projects) == 0 {
 		printError("error:", "no executable target found")
 		os.Exit(1)
 	}
 
-	projectName := cfg.Project.Name
+	// Write .sln
+	slnPath := cfg.Project.Name + ".sln"
+	sln := generateSln(projects)
+	os.WriteFile(slnPath, []byte(sln), 0o644)
+
+	printSuccess("Generated Visual Studio solution:")
+	fmt.Printf("  %s\n", teal(slnPath))
+	for _, proj := range projects {
+		fmt.Printf("  %s\n", teal(proj.path))
+	}
+}
+
+// generateVSProject writes the NMake .vcxproj for one executable target.
+// deps lists its transitive dependencies.
+func generateVSProject(projectName string, mainTarget Target, deps []string) vsProject {
 	guid := projectGUID(projectName)
 
-	// Collect include paths from main target + deps (windows platform), deduplicated
+	// Collect include paths from the target plus the public includes of its
+	// deps (windows platform), deduplicated
 	var includes []string
 	seenInc := map[string]bool{}
 	addInc := func(path string) {
@@ -710,23 +3603,9 @@ func doGenerateVS() {
 			addInc(inc)
 		}
 	}
-	for _, dep := range mainTarget.Deps {
-		if dt, ok := cfg.Targets[dep]; ok {
-			for _, inc := range dt.Includes {
-				addInc(inc)
-			}
-			for _, inc := range dt.SystemIncludes {
-				addInc(inc)
-			}
-			if p, ok := dt.Platform["windows"]; ok {
-				for _, inc := range p.Includes {
-					addInc(inc)
-				}
-				for _, inc := range p.SystemIncludes {
-					addInc(inc)
-				}
-			}
-		}
+	u := usageRequirements(projectName, "windows")
+	for _, inc := range u.includes {
+		addInc(inc)
 	}
 
 	// Convert to backslash paths and join with semicolons for VS
@@ -750,8 +3629,10 @@ func doGenerateVS() {
 		}
 		return strings.Join(defs, ";")
 	}
-	debugDefs := collectDefines(mainTarget.Debug.Flags)
-	releaseDefs := collectDefines(mainTarget.Release.Flags)
+	var publicDefs []string
+	for _, def := range u.defines {
+		publicDefs = append(publicDefs, "-D"+def)
+	}
 
 	// Collect source files from main target and all deps
 	var compileFiles, headerFiles []string
@@ -777,10 +3658,8 @@ func doGenerateVS() {
 		}
 	}
 
-	for _, dep := range mainTarget.Deps {
-		if dt, ok := cfg.Targets[dep]; ok {
-			addSources(dt)
-		}
+	for _, dep := range deps {
+		addSources(cfg.Targets[dep])
 	}
 	addSources(mainTarget)
 
@@ -798,25 +3677,27 @@ func doGenerateVS() {
 		}
 	}
 
-	// Resolve output exe path
-	outputExe := projectName + ".exe"
-	if p, ok := mainTarget.Platform["windows"]; ok && p.Output != "" {
-		outputExe = filepath.FromSlash(filepath.Join(p.Output, projectName+".exe"))
+	// One configuration per build mode, each with its own defines and exe path
+	outputRoot := ""
+	if p, ok := mainTarget.Platform["windows"]; ok {
+		outputRoot = p.Output
+	}
+	var configs []vsConfig
+	for _, m := range buildModes() {
+		configs = append(configs, vsConfig{
+			name:    vsConfigName(m),
+			mode:    m,
+			defines: collectDefines(append(targetMode(mainTarget, m).Flags, publicDefs...)),
+			output:  filepath.FromSlash(filepath.Join(outputRoot, variantName("windows", m), projectName+".exe")),
+		})
 	}
 
 	// Write .vcxproj
 	vcxprojPath := projectName + ".vcxproj"
-	vcxproj := generateVcxproj(projectName, guid, includeStr, debugDefs, releaseDefs, outputExe, compileFiles, headerFiles)
+	vcxproj := generateVcxproj(projectName, guid, includeStr, filepath.FromSlash(mainTarget.PCH), configs, compileFiles, headerFiles)
 	os.WriteFile(vcxprojPath, []byte(vcxproj), 0o644)
 
-	// Write .sln
-	slnPath := projectName + ".sln"
-	sln := generateSln(projectName, guid, vcxprojPath)
-	os.WriteFile(slnPath, []byte(sln), 0o644)
-
-	printSuccess("Generated Visual Studio solution:")
-	fmt.Printf("  %s\n", teal(slnPath))
-	fmt.Printf("  %s\n", teal(vcxprojPath))
+	return vsProject{name: projectName, guid: guid, path: vcxprojPath}
 }
 
 func projectGUID(name string) string {
@@ -826,7 +3707,7 @@ func projectGUID(name string) string {
 		h[8], h[9], h[10], h[11], h[12], h[13], h[14], h[15])
 }
 
-func generateVcxproj(name, guid, includes, debugDefs, releaseDefs, output string, compileFiles, headerFiles []string) string {
+func generateVcxproj(name, guid, includes, forcedIncludes string, configs []vsConfig, compileFiles, headerFiles []string) string {
 	var b strings.Builder
 
 	b.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n")
@@ -834,9 +3715,9 @@ func generateVcxproj(name, guid, includes, debugDefs, releaseDefs, output string
 
 	// Project configurations
 	b.WriteString("  <ItemGroup Label=\"ProjectConfigurations\">\n")
-	for _, conf := range []string{"Debug", "Release"} {
-		b.WriteString(fmt.Sprintf("    <ProjectConfiguration Include=\"%s|x64\">\n", conf))
-		b.WriteString(fmt.Sprintf("      <Configuration>%s</Configuration>\n", conf))
+	for _, conf := range configs {
+		b.WriteString(fmt.Sprintf("    <ProjectConfiguration Include=\"%s|x64\">\n", conf.name))
+		b.WriteString(fmt.Sprintf("      <Configuration>%s</Configuration>\n", conf.name))
 		b.WriteString("      <Platform>x64</Platform>\n")
 		b.WriteString("    </ProjectConfiguration>\n")
 	}
@@ -853,13 +3734,10 @@ func generateVcxproj(name, guid, includes, debugDefs, releaseDefs, output string
 	b.WriteString("  <Import Project=\"$(VCTargetsPath)\\Microsoft.Cpp.Default.props\" />\n")
 
 	// Configuration property groups
-	for _, conf := range []struct {
-		name  string
-		debug bool
-	}{{"Debug", true}, {"Release", false}} {
+	for _, conf := range configs {
 		b.WriteString(fmt.Sprintf("  <PropertyGroup Condition=\"'$(Configuration)|$(Platform)'=='%s|x64'\" Label=\"Configuration\">\n", conf.name))
 		b.WriteString("    <ConfigurationType>Makefile</ConfigurationType>\n")
-		if conf.debug {
+		if conf.mode == "debug" {
 			b.WriteString("    <UseDebugLibraries>true</UseDebugLibraries>\n")
 		} else {
 			b.WriteString("    <UseDebugLibraries>false</UseDebugLibraries>\n")
@@ -870,25 +3748,19 @@ func generateVcxproj(name, guid, includes, debugDefs, releaseDefs, output string
 
 	b.WriteString("  <Import Project=\"$(VCTargetsPath)\\Microsoft.Cpp.props\" />\n")
 
-	// NMake settings — Debug
-	b.WriteString("  <PropertyGroup Condition=\"'$(Configuration)|$(Platform)'=='Debug|x64'\">\n")
-	b.WriteString("    <NMakeBuildCommandLine>larva build</NMakeBuildCommandLine>\n")
-	b.WriteString(fmt.Sprintf("    <NMakeOutput>%s</NMakeOutput>\n", output))
-	b.WriteString("    <NMakeCleanCommandLine>larva clean</NMakeCleanCommandLine>\n")
-	b.WriteString("    <NMakeReBuildCommandLine>larva clean &amp;&amp; larva build</NMakeReBuildCommandLine>\n")
-	b.WriteString(fmt.Sprintf("    <NMakeIncludeSearchPath>%s</NMakeIncludeSearchPath>\n", includes))
-	b.WriteString(fmt.Sprintf("    <NMakePreprocessorDefinitions>%s</NMakePreprocessorDefinitions>\n", debugDefs))
-	b.WriteString("  </PropertyGroup>\n")
-
-	// NMake settings — Release
-	b.WriteString("  <PropertyGroup Condition=\"'$(Configuration)|$(Platform)'=='Release|x64'\">\n")
-	b.WriteString("    <NMakeBuildCommandLine>larva release</NMakeBuildCommandLine>\n")
-	b.WriteString(fmt.Sprintf("    <NMakeOutput>%s</NMakeOutput>\n", output))
-	b.WriteString("    <NMakeCleanCommandLine>larva clean</NMakeCleanCommandLine>\n")
-	b.WriteString("    <NMakeReBuildCommandLine>larva clean &amp;&amp; larva release</NMakeReBuildCommandLine>\n")
-	b.WriteString(fmt.Sprintf("    <NMakeIncludeSearchPath>%s</NMakeIncludeSearchPath>\n", includes))
-	b.WriteString(fmt.Sprintf("    <NMakePreprocessorDefinitions>%s</NMakePreprocessorDefinitions>\n", releaseDefs))
-	b.WriteString("  </PropertyGroup>\n")
+	// NMake settings, one group per configuration
+	for _, conf := range configs {
+		command := larvaCommand(name, conf.mode)
+		b.WriteString(fmt.Sprintf("  <PropertyGroup Condition=\"'$(Configuration)|$(Platform)'=='%s|x64'\">\n", conf.name))
+		b.WriteString(fmt.Sprintf("    <NMakeBuildCommandLine>%s</NMakeBuildCommandLine>\n", command))
+		b.WriteString(fmt.Sprintf("    <NMakeOutput>%s</NMakeOutput>\n", conf.output))
+		b.WriteString("    <NMakeCleanCommandLine>larva clean</NMakeCleanCommandLine>\n")
+		b.WriteString(fmt.Sprintf("    <NMakeReBuildCommandLine>larva clean &amp;&amp; %s</NMakeReBuildCommandLine>\n", command))
+		b.WriteString(fmt.Sprintf("    <NMakeIncludeSearchPath>%s</NMakeIncludeSearchPath>\n", includes))
+		b.WriteString(fmt.Sprintf("    <NMakePreprocessorDefinitions>%s</NMakePreprocessorDefinitions>\n", conf.defines))
+		b.WriteString(fmt.Sprintf("    <NMakeForcedIncludes>%s</NMakeForcedIncludes>\n", forcedIncludes))
+		b.WriteString("  </PropertyGroup>\n")
+	}
 
 	// Source files (ClCompile)
 	if len(compileFiles) > 0 {
@@ -914,8 +3786,12 @@ func generateVcxproj(name, guid, includes, debugDefs, releaseDefs, output string
 	return b.String()
 }
 
-func generateSln(name, projectGuid, vcxprojPath string) string {
+func generateSln(projects []vsProject) string {
 	typeGUID := "{8BC9CEB8-8B4A-11D0-8D11-00A0C91BC942}"
+	var modes []string
+	for _, m := range buildModes() {
+		modes = append(modes, vsConfigName(m))
+	}
 
 	var b strings.Builder
 	b.WriteString("\xEF\xBB\xBF\r\n") // UTF-8 BOM
@@ -923,18 +3799,23 @@ func generateSln(name, projectGuid, vcxprojPath string) string {
 	b.WriteString("# Visual Studio Version 17\r\n")
 	b.WriteString("VisualStudioVersion = 17.0.31903.59\r\n")
 	b.WriteString("MinimumVisualStudioVersion = 10.0.40219.1\r\n")
-	b.WriteString(fmt.Sprintf("Project(\"%s\") = \"%s\", \"%s\", \"%s\"\r\n", typeGUID, name, vcxprojPath, projectGuid))
-	b.WriteString("EndProject\r\n")
+	for _, proj := range projects {
+		b.WriteString(fmt.Sprintf("Project(\"%s\") = \"%s\", \"%s\", \"%s\"\r\n", typeGUID, proj.name, proj.path, proj.guid))
+		b.WriteString("EndProject\r\n")
+	}
 	b.WriteString("Global\r\n")
 	b.WriteString("\tGlobalSection(SolutionConfigurationPlatforms) = preSolution\r\n")
-	b.WriteString("\t\tDebug|x64 = Debug|x64\r\n")
-	b.WriteString("\t\tRelease|x64 = Release|x64\r\n")
+	for _, m := range modes {
+		b.WriteString(fmt.Sprintf("\t\t%s|x64 = %s|x64\r\n", m, m))
+	}
 	b.WriteString("\tEndGlobalSection\r\n")
 	b.WriteString("\tGlobalSection(ProjectConfigurationPlatforms) = postSolution\r\n")
-	b.WriteString(fmt.Sprintf("\t\t%s.Debug|x64.ActiveCfg = Debug|x64\r\n", projectGuid))
-	b.WriteString(fmt.Sprintf("\t\t%s.Debug|x64.Build.0 = Debug|x64\r\n", projectGuid))
-	b.WriteString(fmt.Sprintf("\t\t%s.Release|x64.ActiveCfg = Release|x64\r\n", projectGuid))
-	b.WriteString(fmt.Sprintf("\t\t%s.Release|x64.Build.0 = Release|x64\r\n", projectGuid))
+	for _, proj := range projects {
+		for _, m := range modes {
+			b.WriteString(fmt.Sprintf("\t\t%s.%s|x64.ActiveCfg = %s|x64\r\n", proj.guid, m, m))
+			b.WriteString(fmt.Sprintf("\t\t%s.%s|x64.Build.0 = %s|x64\r\n", proj.guid, m, m))
+		}
+	}
 	b.WriteString("\tEndGlobalSection\r\n")
 	b.WriteString("\tGlobalSection(SolutionProperties) = preSolution\r\n")
 	b.WriteString("\t\tHideSolutionNode = FALSE\r\n")
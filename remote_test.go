@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// standInCache is an in-process stand-in for an HTTP cache such as
+// bazel-remote: PUT stores a body under its path, GET returns it.
+type standInCache struct {
+	mu       sync.Mutex
+	entries  map[string][]byte
+	requests int
+	auth     string        // required Authorization header, if set
+	delay    time.Duration // added to every response
+}
+
+func newStandInCache() *standInCache {
+	return &standInCache{entries: map[string][]byte{}}
+}
+
+func (s *standInCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	if s.auth != "" && r.Header.Get("Authorization") != s.auth {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/ac/") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := s.entries[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		s.entries[r.URL.Path] = data
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestRemoteCacheRoundTrip(t *testing.T) {
+	stand := newStandInCache()
+	srv := httptest.NewServer(stand)
+	defer srv.Close()
+
+	r := newRemoteCache(RemoteCache{URL: srv.URL + "/"})
+	if _, _, ok := r.get("abc123"); ok {
+		t.Fatal("get on an empty cache reported a hit")
+	}
+	r.put("abc123", []byte("object"), []byte("obj.o: src.c"))
+	if _, ok := stand.entries["/ac/abc123"]; !ok {
+		t.Fatalf("put did not store under /ac/<key>, have %v", stand.entries)
+	}
+
+	obj, dep, ok := r.get("abc123")
+	if !ok {
+		t.Fatal("get after put missed")
+	}
+	if string(obj) != "object" || string(dep) != "obj.o: src.c" {
+		t.Fatalf("got obj=%q dep=%q", obj, dep)
+	}
+}
+
+func TestRemoteCacheReadOnly(t *testing.T) {
+	stand := newStandInCache()
+	srv := httptest.NewServer(stand)
+	defer srv.Close()
+
+	r := newRemoteCache(RemoteCache{URL: srv.URL, ReadOnly: true})
+	r.put("abc123", []byte("object"), nil)
+	if stand.requests != 0 || len(stand.entries) != 0 {
+		t.Fatalf("read-only remote uploaded: %d requests", stand.requests)
+	}
+}
+
+func TestRemoteCacheHeadersFromEnv(t *testing.T) {
+	stand := newStandInCache()
+	stand.auth = "Bearer s3cret"
+	srv := httptest.NewServer(stand)
+	defer srv.Close()
+
+	t.Setenv("LARVA_TEST_CACHE_TOKEN", "s3cret")
+	r := newRemoteCache(RemoteCache{
+		URL:     srv.URL,
+		Headers: map[string]string{"Authorization": "Bearer ${LARVA_TEST_CACHE_TOKEN}"},
+	})
+	r.put("abc123", []byte("object"), nil)
+	if _, _, ok := r.get("abc123"); !ok {
+		t.Fatal("authenticated round trip failed")
+	}
+}
+
+func TestRemoteCacheRejectedGetFallsBack(t *testing.T) {
+	stand := newStandInCache()
+	stand.auth = "Bearer s3cret"
+	srv := httptest.NewServer(stand)
+	defer srv.Close()
+
+	r := newRemoteCache(RemoteCache{URL: srv.URL})
+	if _, _, ok := r.get("abc123"); ok {
+		t.Fatal("unauthorized get reported a hit")
+	}
+	// A rejected download disables the remote like a failed upload does
+	r.get("abc123")
+	r.put("abc123", []byte("object"), nil)
+	if stand.requests != 1 {
+		t.Fatalf("expected 1 request after the rejection, got %d", stand.requests)
+	}
+}
+
+func TestRemoteCacheTimeoutFallsBack(t *testing.T) {
+	stand := newStandInCache()
+	stand.delay = 200 * time.Millisecond
+	srv := httptest.NewServer(stand)
+	defer srv.Close()
+
+	r := newRemoteCache(RemoteCache{URL: srv.URL, Timeout: "20ms"})
+	if _, _, ok := r.get("abc123"); ok {
+		t.Fatal("timed out get reported a hit")
+	}
+	// The remote is now skipped without further requests
+	r.get("abc123")
+	r.put("abc123", []byte("object"), nil)
+	time.Sleep(2 * stand.delay)
+	stand.mu.Lock()
+	defer stand.mu.Unlock()
+	if stand.requests != 1 {
+		t.Fatalf("expected 1 request after the timeout, got %d", stand.requests)
+	}
+}
+
+func TestObjectCacheFetchesFromRemote(t *testing.T) {
+	stand := newStandInCache()
+	srv := httptest.NewServer(stand)
+	defer srv.Close()
+
+	// Populate the remote from one machine's cache...
+	ci := &objectCache{dir: t.TempDir(), remote: newRemoteCache(RemoteCache{URL: srv.URL})}
+	out := t.TempDir()
+	job := compileJob{obj: filepath.Join(out, "a.o"), dep: filepath.Join(out, "a.d")}
+	os.WriteFile(job.obj, []byte("object"), 0o644)
+	os.WriteFile(job.dep, []byte("a.o: a.c"), 0o644)
+	key := strings.Repeat("ab", 32)
+	ci.store(key, job)
+
+	// ...and fetch it on another with an empty local cache
+	dev := &objectCache{dir: t.TempDir(), remote: newRemoteCache(RemoteCache{URL: srv.URL, ReadOnly: true})}
+	dst := t.TempDir()
+	devJob := compileJob{obj: filepath.Join(dst, "a.o"), dep: filepath.Join(dst, "a.d")}
+	if !dev.fetch(key, devJob) {
+		t.Fatal("fetch missed an entry present in the remote cache")
+	}
+	if data, _ := os.ReadFile(devJob.obj); string(data) != "object" {
+		t.Fatalf("fetched object = %q", data)
+	}
+	if dev.remoteHits != 1 {
+		t.Fatalf("remoteHits = %d, want 1", dev.remoteHits)
+	}
+	if _, err := os.Stat(filepath.Join(dev.entryDir(key), "obj")); err != nil {
+		t.Fatal("remote hit was not kept in the local cache")
+	}
+}